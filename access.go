@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	accessQueue   = make(chan string, 1<<10)
+	accessFlush   = make(chan chan struct{})
+	accessDropped = int64(0)
+	accessFile    *os.File
+)
+
+func accessOpen() (err error) {
+	if Accesslog == "-" {
+		accessFile = os.Stdout
+		return nil
+	}
+	file, err := os.OpenFile(Accesslog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if accessFile != nil {
+		accessFile.Close()
+	}
+	accessFile = file
+	return nil
+}
+
+func accessRun() {
+	if err := accessOpen(); err != nil {
+		os.Stderr.WriteString(err.Error() + " - aborting\n")
+		os.Exit(1)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case line := <-accessQueue:
+				accessFile.WriteString(line)
+
+			case <-signals:
+				if Accesslog != "-" {
+					if err := accessOpen(); err != nil {
+						os.Stderr.WriteString("\r" + err.Error() + " - ignoring     \n")
+					}
+				}
+
+			case done := <-accessFlush:
+			drain:
+				for {
+					select {
+					case line := <-accessQueue:
+						accessFile.WriteString(line)
+
+					default:
+						break drain
+					}
+				}
+				if Accesslog != "-" {
+					accessFile.Sync()
+					accessFile.Close()
+				}
+				close(done)
+				return
+			}
+		}
+	}()
+}
+
+func accessClose() {
+	done := make(chan struct{})
+	accessFlush <- done
+	<-done
+}
+
+func accessLog(request *http.Request, user string, start time.Time, srange string, status int, sent int64, elapsed time.Duration) {
+	if Accesslog == "" {
+		return
+	}
+	remote := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	line := ""
+	switch Logformat {
+	case "common", "combined":
+		if user == "" {
+			user = "-"
+		}
+		size := "-"
+		if sent != 0 {
+			size = strconv.FormatInt(sent, 10)
+		}
+		line = remote + " - " + user + " [" + start.Format("02/Jan/2006:15:04:05 -0700") + `] "` + request.Method + " " + request.RequestURI + " " + request.Proto + `" ` + strconv.Itoa(status) + " " + size
+		if Logformat == "combined" {
+			for _, value := range []string{request.Referer(), request.UserAgent()} {
+				if value == "" {
+					value = "-"
+				}
+				line += " " + strconv.Quote(value)
+			}
+		}
+		line += "\n"
+
+	default:
+		payload, _ := json.Marshal(map[string]any{
+			"time":      start.Format(time.RFC3339Nano),
+			"remote":    remote,
+			"user":      user,
+			"method":    request.Method,
+			"path":      request.URL.Path,
+			"range":     srange,
+			"status":    status,
+			"bytes":     sent,
+			"duration":  elapsed.Seconds(),
+			"bandwidth": utilBandwidth((float64(sent) * 8) / (float64(max(elapsed, time.Microsecond)) / float64(time.Second))),
+		})
+		line = string(payload) + "\n"
+	}
+
+	select {
+	case accessQueue <- line:
+
+	default:
+		atomic.AddInt64(&accessDropped, 1)
+	}
+}
@@ -1,51 +1,32 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
-	"io"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/pyke369/golang-support/bslab"
-	"github.com/pyke369/golang-support/rcache"
+	"github.com/pyke369/golang-support/multiflag"
+	"github.com/pyke369/mfetch/transfer"
 )
 
-type clientChunk struct {
-	id       int
-	size     int64
-	start    int64
-	offset   int64
-	end      int64
-	request  []byte
-	response []byte
-	status   int
-	modified int64
-	etag     string
-	file     *os.File
-	stdout   bool
-	writer   *io.PipeWriter
-	data     []byte
-}
-
 var (
+	clientContext   context.Context
+	clientInterrupt context.CancelFunc
 	clientTransport *http.Transport
 	clientClient    *http.Client
-	clientSize      = int64(0)
-	clientReceived  = int64(0)
-	clientEvent     = "start"
-	clientProgress  = [32][3]int64{}
-	clientResume    = ""
-	clientLock      sync.Mutex
+	clientSlots     chan struct{}
+	clientLimiter   = &transfer.Limiter{}
 )
 
 func clientAbort(exit int, message string) {
@@ -58,416 +39,397 @@ func clientAbort(exit int, message string) {
 	os.Exit(exit)
 }
 
-func clientRequest(chunk *clientChunk) (err error) {
-	request, err := http.NewRequest(http.MethodGet, Flagset.Args()[0], http.NoBody)
-	if err != nil {
-		return err
-	}
-	request.Header.Set("User-Agent", PROGNAME+"/"+PROGVER)
-	for _, header := range Source {
-		if strings.EqualFold(header[0], "host") {
-			request.Host = header[1]
-
-		} else {
-			request.Header.Set(header[0], header[1])
-		}
-	}
-	request.Header.Set("Range", "bytes="+strconv.FormatInt(chunk.offset, 10)+"-"+strconv.FormatInt(chunk.end, 10))
-	if Dump {
-		chunk.request, _ = httputil.DumpRequest(request, false)
-	}
-
-	response, err := clientClient.Do(request)
-	if err != nil {
-		return err
-	}
-	if Dump {
-		chunk.response, _ = httputil.DumpResponse(response, false)
-	}
-
-	chunk.status = response.StatusCode
-	chunk.etag = strings.TrimSpace(response.Header.Get("Etag"))
-	if modified, err := time.Parse(time.RFC1123, response.Header.Get("Last-Modified")); err == nil {
-		chunk.modified = modified.Unix()
-	}
-	if captures := rcache.Get(`^bytes (\d+)-\d+/(\d+)$`).FindStringSubmatch(response.Header.Get("Content-Range")); captures != nil && chunk.status == http.StatusPartialContent {
-		chunk.offset, _ = strconv.ParseInt(captures[1], 10, 64)
-		chunk.size, _ = strconv.ParseInt(captures[2], 10, 64)
+func clientSetup() {
+	clientContext, clientInterrupt = context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		clientInterrupt()
+		<-signals
+		os.Stderr.WriteString("\r                                                       \r" + transfer.ErrInterrupted.Error() + " - aborting\n")
+		os.Exit(8)
+	}()
 
-	} else {
-		chunk.offset, chunk.size = 0, response.ContentLength
-	}
-	if chunk.status/100 != 2 {
-		response.Body.Close()
-		return errors.New("source http status " + strconv.Itoa(chunk.status))
+	clientTransport = &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: time.Duration(Timeout) * time.Second}).DialContext,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: Insecure},
+		TLSHandshakeTimeout:   time.Duration(Timeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(Timeout) * time.Second,
+		ReadBufferSize:        8 << 20,
+		WriteBufferSize:       1 << 20,
+		MaxIdleConnsPerHost:   32,
 	}
-	if chunk.size == 0 || (chunk.size < 0 && chunk.start == 0 && chunk.end == 0) {
-		response.Body.Close()
-		return nil
+	if CA != "" {
+		content, err := os.ReadFile(CA)
+		if err != nil {
+			clientAbort(1, err.Error())
+		}
+		clientTransport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		if !clientTransport.TLSClientConfig.RootCAs.AppendCertsFromPEM(content) {
+			clientAbort(1, "no certificate found in CA bundle "+CA)
+		}
 	}
+	if Pin != "" {
+		pins := map[string]bool{}
+		for _, value := range strings.Split(Pin, ",") {
+			pin, err := utilPin(value)
+			if err != nil {
+				clientAbort(1, err.Error())
+			}
+			pins[pin] = true
+		}
 
-	data := make([]byte, 64<<10)
-	for {
-		read, err := response.Body.Read(data)
-		if read > 0 {
-			atomic.AddInt64(&clientReceived, int64(read))
-			switch {
-			case chunk.file != nil:
-				if chunk.start < 0 && chunk.end < 0 {
-					_, err = chunk.file.Write(data[:read])
+		// pinned certificates are usually self-signed: the chain is only verified if a CA bundle is provided
+		config := clientTransport.TLSClientConfig
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("no remote certificate")
+			}
 
-				} else {
-					clientLock.Lock()
-					_, err = chunk.file.WriteAt(data[:read], chunk.offset)
-					clientLock.Unlock()
+			// only the leaf is trusted without a CA bundle (the rest of the chain is not authenticated by the handshake)
+			candidates := state.PeerCertificates[:1]
+			if config.RootCAs != nil && !Insecure {
+				intermediates := x509.NewCertPool()
+				for _, certificate := range state.PeerCertificates[1:] {
+					intermediates.AddCert(certificate)
 				}
+				chains, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: config.RootCAs, Intermediates: intermediates, DNSName: state.ServerName})
 				if err != nil {
-					response.Body.Close()
 					return err
 				}
-
-			case chunk.stdout:
-				if _, err = os.Stdout.Write(data[:read]); err != nil {
-					response.Body.Close()
-					return err
+				candidates = nil
+				for _, chain := range chains {
+					candidates = append(candidates, chain...)
 				}
-
-			case chunk.writer != nil:
-				if _, err = chunk.writer.Write(data[:read]); err != nil {
-					response.Body.Close()
-					return err
-				}
-
-			case chunk.data != nil:
-				copy(chunk.data[chunk.offset-chunk.start:], data[:read])
 			}
-			chunk.offset += int64(read)
-			if chunk.file != nil {
-				clientProgress[chunk.id][0], clientProgress[chunk.id][1], clientProgress[chunk.id][2] = chunk.start, max(chunk.start, chunk.offset-1), chunk.end
+			for _, certificate := range candidates {
+				if pins[utilFingerprint(certificate.Raw)] || pins[utilFingerprint(certificate.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
 			}
+			return errors.New("remote certificate " + utilFingerprint(state.PeerCertificates[0].Raw) + " does not match pinned fingerprints")
 		}
+	}
+	if ClientCert != "" {
+		if ClientKey == "" {
+			ClientKey = ClientCert
+		}
+		certificate, err := tls.LoadX509KeyPair(ClientCert, ClientKey)
 		if err != nil {
-			response.Body.Close()
-			if err != io.EOF {
-				return err
-			}
-			if chunk.size > 0 && chunk.offset != chunk.end+1 {
-				return errors.New("truncated transfer")
-			}
-			return nil
+			clientAbort(1, err.Error())
 		}
-	}
-}
-
-func Client() {
-	if Flagset.NArg() < 1 {
-		Flagset.Usage()
-		os.Exit(1)
-	}
-	target := ""
-	if Flagset.NArg() > 1 {
-		target = Flagset.Args()[1]
-	}
-	clientTransport = &http.Transport{
-		DialContext:           (&net.Dialer{Timeout: time.Duration(Timeout) * time.Second}).DialContext,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: Insecure},
-		TLSHandshakeTimeout:   time.Duration(Timeout) * time.Second,
-		ResponseHeaderTimeout: time.Duration(Timeout) * time.Second,
-		ReadBufferSize:        8 << 20,
-		MaxIdleConnsPerHost:   32,
+		clientTransport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
 	}
 	clientClient = &http.Client{Transport: clientTransport}
+}
 
-	chunk := clientChunk{}
-	err := clientRequest(&chunk)
-	if Dump {
-		os.Stderr.WriteString(string(chunk.request) + string(chunk.response))
+func clientRatelimit() {
+	load := func() error {
+		value := Ratelimit
+		if strings.HasPrefix(value, "@") {
+			content, err := os.ReadFile(value[1:])
+			if err != nil {
+				return err
+			}
+			value = string(content)
+		}
+		bandwidth, err := utilParseBandwidth(value)
+		if err != nil {
+			return err
+		}
+		clientLimiter.Set(bandwidth)
+		return nil
 	}
-	if err != nil {
+	if err := load(); err != nil {
 		clientAbort(1, err.Error())
 	}
-	clientSize, clientReceived = chunk.size, 0
-	if chunk.status != http.StatusPartialContent || clientSize < 0 {
-		Concurrency = 1
+	if strings.HasPrefix(Ratelimit, "@") {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			for range signals {
+				if err := load(); err != nil {
+					os.Stderr.WriteString("\r                                                       \r" + err.Error() + " - ignoring\n")
+				}
+			}
+		}()
 	}
-	if clientSize > 0 && clientSize/int64(Concurrency) <= 4<<20 {
-		Concurrency = int(clientSize / (4 << 20))
-		if clientSize%(4<<20) != 0 {
-			Concurrency++
+}
+
+func clientCap(json bool) string {
+	if bandwidth := clientLimiter.Rate(); bandwidth > 0 {
+		if json {
+			return `,"ratelimit":"` + utilBandwidth(bandwidth) + `"`
 		}
+		return " (max " + utilBandwidth(bandwidth) + ")"
 	}
+	return ""
+}
 
-	var (
-		file   *os.File
-		reader *io.PipeReader
-		writer *io.PipeWriter
-	)
-
-	waiter1, done := sync.WaitGroup{}, make(chan bool, 1)
-	if target == "-" {
-		Progress = false
+func clientHeaders(values multiflag.Multiflag) (headers http.Header) {
+	headers = http.Header{}
+	for _, header := range values {
+		headers.Set(header[0], header[1])
+	}
+	return
+}
 
-	} else if target != "" {
-		if strings.HasPrefix(target, "http") {
-			method := http.MethodPut
-			if Post {
-				method = http.MethodPost
-			}
-			reader, writer = io.Pipe()
-			request, err := http.NewRequest(method, target, reader)
-			if err != nil {
-				clientAbort(2, err.Error())
-			}
-			request.Header.Set("User-Agent", PROGNAME+"/"+PROGVER)
-			request.Header.Set("Content-Type", "application/octet-stream")
-			for _, header := range Target {
-				request.Header.Set(header[0], header[1])
-			}
-			request.ContentLength = clientSize
-			if Dump {
-				dump, _ := httputil.DumpRequest(request, false)
-				os.Stderr.Write(dump)
-			}
-			waiter1.Add(1)
-			go func() {
-				response, err := clientClient.Do(request)
-				if err != nil {
-					clientAbort(4, err.Error())
-				}
-				if Dump {
-					dump, _ := httputil.DumpResponse(response, true)
-					os.Stderr.WriteString("\r                                                            \n" + string(dump))
-				}
-				response.Body.Close()
-				if response.StatusCode/100 != 2 {
-					clientAbort(4, "target http status "+strconv.Itoa(response.StatusCode))
-				}
-				waiter1.Done()
-			}()
+func clientCode(err error) int {
+	var failure *transfer.Error
+	if errors.As(err, &failure) {
+		return failure.Code
+	}
+	return 1
+}
 
-		} else {
-			if _, err := os.Stat(target); err != nil || Noresume {
-				os.Remove(filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".resume"))
-			}
-			os.MkdirAll(filepath.Dir(target), 0o755)
-			if clientSize < 0 {
-				file, err = os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0o644)
+func clientLabel(source, target string, batch bool) string {
+	if batch {
+		return `,"source":` + strconv.Quote(source) + `,"target":` + strconv.Quote(target)
+	}
+	return ""
+}
 
-			} else {
-				file, err = os.OpenFile(target, os.O_CREATE|os.O_RDWR, 0o644)
+func clientProgress(source, target string, batch bool) func(transfer.Status) {
+	label, verbose, progress := clientLabel(source, target, batch), Verbose && !batch, Progress && !batch
+	initial, previous, bandwidth := int64(0), int64(0), float64(0)
+	return func(status transfer.Status) {
+		switch status.Event {
+		case "start", "progress", "end":
+			if !verbose && !progress {
+				return
 			}
-			if err != nil {
-				clientAbort(2, err.Error())
-			}
-			if !Noresume {
-				clientResume = filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".resume")
-				if info, err := file.Stat(); err == nil && chunk.modified <= info.ModTime().Unix() {
-					if payload, err := os.ReadFile(clientResume); err == nil {
-						var progress [][3]int64
-
-						if json.Unmarshal(payload, &progress) == nil {
-							if len(progress) >= 1 && len(progress) <= 32 {
-								resume := true
-								for index, chunk := range progress {
-									if chunk[0] < 0 || chunk[1] >= clientSize || chunk[2] >= clientSize || chunk[0] > chunk[1] || chunk[0] > chunk[2] || chunk[1] > chunk[2] ||
-										(index == 0 && chunk[0] != 0) || (index == len(progress)-1 && chunk[2] != clientSize-1) || (index != 0 && chunk[0] <= progress[index-1][2]) {
-										resume = false
-										break
-									}
-								}
-								if resume {
-									Concurrency = len(progress)
-									for index, chunk := range progress {
-										clientProgress[index] = chunk
-										clientReceived += chunk[1] - chunk[0] + 1
-									}
-								}
-							}
-						}
-					}
-				}
+			received, size, elapsed := status.Received, status.Size, status.Elapsed.Seconds()
+			if status.Event == "start" {
+				initial, previous = received, received
 			}
-			file.Truncate(max(0, clientSize))
-		}
-	}
-
-	if Verbose || Progress {
-		waiter1.Add(1)
-		go func() {
-			start, initial, previous, bandwidth := time.Now(), atomic.LoadInt64(&clientReceived), atomic.LoadInt64(&clientReceived), float64(0)
-			for {
-				received := atomic.LoadInt64(&clientReceived)
+			if status.Event != "end" || status.Err == nil {
 				bandwidth = float64((received - previous) * 8)
-				if Verbose {
-					if clientSize < 0 {
-						os.Stderr.WriteString("\r" + strconv.Itoa(Concurrency) +
+				if verbose {
+					if size < 0 {
+						os.Stderr.WriteString("\r" + strconv.Itoa(status.Concurrency) +
 							" | " + utilSize(received) +
-							" | " + utilBandwidth(bandwidth) +
-							" | " + utilDuration(int(time.Since(start)/time.Second)) +
+							" | " + utilBandwidth(bandwidth) + clientCap(false) +
+							" | " + utilDuration(int(elapsed)) +
 							"     ")
 
 					} else {
-						mbandwidth := float64((received-initial)*8) / (float64(time.Since(start)) / float64(time.Second))
+						mbandwidth := float64((received-initial)*8) / elapsed
 						if mbandwidth == 0 {
 							mbandwidth = -1
 						}
-						os.Stderr.WriteString("\r" + strconv.Itoa(Concurrency) +
+						os.Stderr.WriteString("\r" + strconv.Itoa(status.Concurrency) +
 							" | " + utilSize(received) +
-							"/" + utilSize(clientSize) +
-							" | " + strconv.FormatFloat(float64(received*100)/float64(clientSize), 'f', 2, 64) +
-							"% | " + utilBandwidth(bandwidth) +
-							" | " + utilDuration(int(time.Since(start)/time.Second)) +
-							"/" + utilDuration(int(float64((clientSize-initial)*8)/mbandwidth)) +
+							"/" + utilSize(size) +
+							" | " + strconv.FormatFloat(float64(received*100)/float64(size), 'f', 2, 64) +
+							"% | " + utilBandwidth(bandwidth) + clientCap(false) +
+							" | " + utilDuration(int(elapsed)) +
+							"/" + utilDuration(int(float64((size-initial)*8)/mbandwidth)) +
 							"     ")
 					}
 				}
-				if received == clientSize {
-					clientEvent = "end"
-					bandwidth = float64((clientSize-initial)*8) / (float64(time.Since(start)) / float64(time.Second))
+				if status.Event == "end" {
+					bandwidth = float64((size-initial)*8) / elapsed
 				}
-				if Progress {
-					line := `{"event":"` + clientEvent +
-						`","concurrency":` + strconv.Itoa(Concurrency) +
-						`,"size":` + strconv.FormatInt(clientSize, 10) +
-						`,"received":` + strconv.FormatInt(clientReceived, 10) +
+				if progress {
+					line := `{"event":"` + status.Event +
+						`","concurrency":` + strconv.Itoa(status.Concurrency) +
+						`,"size":` + strconv.FormatInt(size, 10) +
+						`,"received":` + strconv.FormatInt(received, 10) +
+						`,"retries":` + strconv.FormatInt(status.Retries, 10) +
 						`,"bandwidth":"` + utilBandwidth(bandwidth) +
-						`","elapsed":` + strconv.FormatFloat(float64(time.Since(start))/float64(time.Second), 'f', 2, 64)
-					if clientSize >= 0 {
-						line += `,"progress":` + strconv.FormatFloat(float64(clientReceived*100)/float64(clientSize), 'f', 2, 64)
+						`","elapsed":` + strconv.FormatFloat(elapsed, 'f', 2, 64)
+					line += clientCap(true)
+					if size >= 0 {
+						line += `,"progress":` + strconv.FormatFloat(float64(received*100)/float64(size), 'f', 2, 64)
 					}
 					os.Stdout.WriteString(line + "}\n")
-					if clientEvent == "start" {
-						clientEvent = "progress"
-					}
 				}
 				previous = received
-				if clientResume != "" {
-					if payload, err := json.Marshal(clientProgress[:Concurrency]); err == nil {
-						os.WriteFile(clientResume, payload, 0o644)
-					}
-				}
-				if clientSize >= 0 && received >= clientSize {
-					if clientResume != "" {
-						os.Remove(clientResume)
-					}
-					break
-				}
-				select {
-				case <-done:
-					clientSize = atomic.LoadInt64(&clientReceived)
-
-				case <-time.After(time.Second):
-				}
 			}
-			if Verbose {
-				os.Stderr.WriteString("\r" + strconv.Itoa(Concurrency) +
-					" | " + utilSize(clientSize) +
+			if status.Event == "end" && verbose {
+				os.Stderr.WriteString("\r" + strconv.Itoa(status.Concurrency) +
+					" | " + utilSize(received) +
 					" | " + utilBandwidth(bandwidth) +
-					" | " + utilDuration(int(time.Since(start)/time.Second)) +
+					" | " + utilDuration(int(elapsed)) +
 					"                             \n")
 			}
-			waiter1.Done()
-		}()
-	}
 
-	if target == "" || file != nil {
-		waiter2, size := sync.WaitGroup{}, clientSize/int64(Concurrency)
-		for worker := 0; worker < Concurrency; worker++ {
-			start, offset, end := int64(worker)*size, int64(worker)*size, min((int64(worker)*size)+size, clientSize)-1
-			if worker >= Concurrency-1 {
-				end = clientSize - 1
+		case "retry":
+			if Progress {
+				os.Stdout.WriteString(`{"event":"retry"` + label +
+					`,"chunk":` + strconv.Itoa(status.Chunk) +
+					`,"attempt":` + strconv.Itoa(status.Attempt) +
+					`,"offset":` + strconv.FormatInt(status.Offset, 10) +
+					`,"retries":` + strconv.FormatInt(status.Retries, 10) +
+					`,"delay":` + strconv.FormatFloat(status.Delay.Seconds(), 'f', 2, 64) +
+					`,"message":` + strconv.Quote(status.Err.Error()) + `}` + "\n")
 			}
-			if clientSize < 0 {
-				start, end = -1, -1
-			}
-			if clientProgress[worker][1] != 0 || clientProgress[worker][2] != 0 {
-				start, offset, end = clientProgress[worker][0], clientProgress[worker][1], clientProgress[worker][2]
-			}
-			waiter2.Add(1)
-			go func(worker int, start, offset, end int64) {
-				chunk := clientChunk{id: worker, start: start, offset: offset, end: end, file: file}
-				if err := clientRequest(&chunk); err != nil {
-					clientAbort(3, err.Error())
-				}
-				waiter2.Done()
-			}(worker, start, offset, end)
-		}
-		waiter2.Wait()
-		file.Close()
 
-	} else {
-		chunks, batches, size, index := [][3]int64{}, clientSize/int64(Maxmem), int64(Maxmem/Concurrency), 0
-		if clientSize%int64(Maxmem) != 0 {
-			batches++
-		}
-		for batch := int64(0); batch < batches; batch++ {
-			for worker := 0; worker < Concurrency; worker++ {
-				start, offset, end := (batch*int64(Maxmem))+int64(worker)*size, (batch*int64(Maxmem))+int64(worker)*size, min((batch*int64(Maxmem))+(int64(worker)*size)+size, clientSize)-1
-				if clientSize < 0 {
-					start, end = -1, -1
-				}
-				chunks = append(chunks, [3]int64{start, offset, end})
-				if end >= clientSize-1 {
-					break
+		case "ignore", "drop":
+			if verbose {
+				if status.Event == "ignore" {
+					os.Stderr.WriteString("mirror " + status.Mirror + " ignored (" + status.Err.Error() + ")\n")
+
+				} else {
+					os.Stderr.WriteString("\r                                                       \rmirror " + status.Mirror + " dropped (" + status.Err.Error() + ")\n")
 				}
 			}
-		}
+			if Progress {
+				os.Stdout.WriteString(`{"event":"drop"` + label + `,"mirror":` + strconv.Quote(status.Mirror) + `,"message":` + strconv.Quote(status.Err.Error()) + "}\n")
+			}
 
-		queue, received, sent := make(chan clientChunk, Concurrency), make([]*clientChunk, len(chunks)), 0
-		for index = 0; index < Concurrency; index++ {
-			go func(index int, start, offset, end int64) {
-				chunk := clientChunk{id: index, start: start, offset: offset, end: end}
-				if start < 0 && end < 0 {
-					chunk.stdout, chunk.writer = target == "-", writer
-				} else {
-					chunk.data = bslab.Get(int(end-start+1), nil)
-					chunk.data = chunk.data[:cap(chunk.data)]
+		case "resume":
+			if status.Err != nil {
+				prefix := ""
+				if batch {
+					prefix = source + " - "
 				}
-				if err := clientRequest(&chunk); err != nil {
-					clientAbort(3, err.Error())
+				os.Stderr.WriteString("\r                                                       \r" + prefix + "resume state ignored (" + status.Err.Error() + ") - restarting\n")
+				if Progress {
+					os.Stdout.WriteString(`{"event":"resume"` + label + `,"status":"refused","message":` + strconv.Quote(status.Err.Error()) + "}\n")
 				}
-				queue <- chunk
-			}(index, chunks[index][0], chunks[index][1], chunks[index][2])
-		}
-		for {
-			chunk := <-queue
-			if chunk.stdout || chunk.writer != nil {
-				break
+				return
 			}
-			received[chunk.id] = &chunk
-			for sent < len(chunks) && received[sent] != nil {
-				if target == "-" {
-					if _, err := os.Stdout.Write(received[sent].data[:received[sent].end-received[sent].start+1]); err != nil {
-						clientAbort(4, err.Error())
-					}
-				} else if writer != nil {
-					if _, err := writer.Write(received[sent].data[:received[sent].end-received[sent].start+1]); err != nil {
-						clientAbort(4, err.Error())
-					}
-				}
-				bslab.Put(received[sent].data)
-				sent++
+			if Progress {
+				os.Stdout.WriteString(`{"event":"resume"` + label + `,"status":"accepted","received":` + strconv.FormatInt(status.Received, 10) + "}\n")
 			}
-			if sent >= len(chunks) {
-				break
+
+		case "verify":
+			if verbose {
+				os.Stderr.WriteString(status.Algorithm + " " + hex.EncodeToString(status.Digest) + " verified\n")
 			}
-			if index < len(chunks) {
-				go func(index int, start, offset, end int64) {
-					chunk := clientChunk{id: index, start: start, offset: offset, end: end, data: bslab.Get(int(end-start+1), nil)}
-					chunk.data = chunk.data[:cap(chunk.data)]
-					if err := clientRequest(&chunk); err != nil {
-						clientAbort(3, err.Error())
-					}
-					queue <- chunk
-				}(index, chunks[index][0], chunks[index][1], chunks[index][2])
-				index++
+			if Progress {
+				os.Stdout.WriteString(`{"event":"verify"` + label + `,"algorithm":"` + status.Algorithm + `","digest":"` + hex.EncodeToString(status.Digest) + `"}` + "\n")
 			}
 		}
 	}
+}
+
+func clientConfig(source, target string, mirrors []string, batch bool) (config transfer.Config) {
+	config = transfer.Config{
+		Source:        source,
+		Target:        target,
+		Mirrors:       mirrors,
+		Headers:       clientHeaders(Source),
+		TargetHeaders: clientHeaders(Target),
+		Post:          Post,
+		Concurrency:   Concurrency,
+		Adaptive:      Adaptive,
+		Memory:        Maxmem,
+		Retries:       Retries,
+		Verify:        Verify,
+		Resume:        !Noresume,
+		UserAgent:     PROGNAME + "/" + PROGVER,
+		Client:        clientClient,
+		Limiter:       clientLimiter,
+		Slots:         clientSlots,
+		Progress:      clientProgress(source, target, batch),
+	}
+	if target == "-" {
+		config.Target, config.Writer = "", os.Stdout
+	}
+	if Retries == 0 {
+		config.Retries = -1
+	}
+	if Dump {
+		config.Dump = os.Stderr
+	}
+	return
+}
+
+func clientRun(source, target string, mirrors []string, batch bool, hook func(*transfer.Transfer)) (t *transfer.Transfer, err error) {
+	if target == "-" && batch {
+		return nil, &transfer.Error{Code: transfer.CodeTarget, Err: errors.New("standard output target not allowed in manifest")}
+	}
+	for attempt := 0; ; attempt++ {
+		t = transfer.New(clientConfig(source, target, mirrors, batch))
+		if hook != nil {
+			hook(t)
+		}
+		if err = t.Run(clientContext); err == nil || !errors.Is(err, transfer.ErrChanged) || Onchange != "restart" || attempt >= 2 {
+			return t, err
+		}
+		if Verbose && !batch {
+			os.Stderr.WriteString("\r                                                       \r" + err.Error() + " - restarting\n")
+		}
+		if Progress {
+			os.Stdout.WriteString(`{"event":"restart"` + clientLabel(source, target, batch) + `,"message":` + strconv.Quote(err.Error()) + "}\n")
+		}
+	}
+}
+
+func clientSign() {
+	if Secret == "" || Flagset.NArg() < 1 {
+		clientAbort(1, "signing requires a secret and an URL")
+	}
+	parts := strings.Split(Sign, ",")
+	validity, err := time.ParseDuration(strings.TrimSpace(parts[0]))
+	if err != nil || validity <= 0 || len(parts) > 3 {
+		clientAbort(1, "invalid signature parameters "+Sign)
+	}
+	link, err := url.Parse(Flagset.Args()[0])
+	if err != nil {
+		clientAbort(1, err.Error())
+	}
+	scope, address := "", ""
+	if len(parts) > 1 {
+		scope = strings.TrimSpace(parts[1])
+	}
+	if len(parts) > 2 {
+		address = strings.TrimSpace(parts[2])
+	}
+	if scope != "" {
+		if !strings.HasSuffix(scope, "/") {
+			clientAbort(1, "invalid scope "+scope+" (must end with /)")
+		}
+		if !strings.HasPrefix(link.Path, scope) {
+			clientAbort(1, "url path "+link.Path+" outside of scope "+scope)
+		}
+	}
+
+	expires, query := time.Now().Add(validity).Unix(), link.Query()
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	if address != "" {
+		query.Set("ip", address)
+	}
+	query.Set("signature", utilSignature(Secret, link.Path, scope, expires, address))
+	link.User, link.RawQuery = nil, query.Encode()
+	os.Stdout.WriteString(link.String() + "\n")
+}
+
+func Client() {
+	if Sign != "" {
+		clientSign()
+		return
+	}
+	clientSetup()
+	clientRatelimit()
+	if Manifest != "" {
+		clientManifest()
+		return
+	}
 
-	if writer != nil {
-		writer.Close()
+	if Flagset.NArg() < 1 {
+		Flagset.Usage()
+		os.Exit(1)
+	}
+	target := ""
+	if Flagset.NArg() > 1 {
+		target = Flagset.Args()[1]
+	}
+	if Recursive {
+		clientMirror(Flagset.Args()[0], target)
+		return
+	}
+	if target == "-" {
+		Progress = false
+	}
+	if _, err := clientRun(Flagset.Args()[0], target, Mirrors, false, nil); err != nil {
+		clientAbort(clientCode(err), err.Error())
 	}
-	done <- true
-	waiter1.Wait()
 }
@@ -7,19 +7,23 @@ import (
 	"strings"
 
 	"github.com/pyke369/golang-support/multiflag"
+	"github.com/pyke369/mfetch/transfer"
 )
 
 const (
 	PROGNAME = "mfetch"
-	PROGVER  = "1.3.0"
+	PROGVER  = transfer.Version
 )
 
 var (
 	Flagset     = flag.NewFlagSet(PROGNAME, flag.ExitOnError)
+	Mirrors     = mainList{}
 	Version     = false
 	Concurrency = 6
+	Adaptive    = false
 	Maxmem      = 6 * 64 << 20
 	Timeout     = 10
+	Retries     = 5
 	Source      = multiflag.Multiflag{}
 	Target      = multiflag.Multiflag{}
 	Post        = false
@@ -28,11 +32,46 @@ var (
 	Verbose     = false
 	Dump        = false
 	Progress    = false
+	Verify      = ""
 	Listen      = ""
-	Certificate = ""
+	Certificate = mainList{}
 	Password    = ""
+	Writable    = false
+	Digest      = false
+	Egress      = ""
+	Manifest    = ""
+	Recursive   = false
+	Ratelimit   = ""
+	Onchange    = "abort"
+	Parallel    = 4
+	Metrics     = ""
+	Accesslog   = ""
+	Logformat   = "json"
+	Secret      = ""
+	Sign        = ""
+	Users       = ""
+	ClientCert  = ""
+	ClientKey   = ""
+	ClientCA    = ""
+	ClientID    = ""
+	CA          = ""
+	Pin         = ""
+	Drain       = 30
 )
 
+type mainList []string
+
+func (l *mainList) Set(value string) error {
+	if value = strings.TrimSpace(value); value != "" {
+		*l = append(*l, value)
+	}
+	return nil
+}
+
+func (l *mainList) String() string {
+	return ""
+}
+
 func main() {
 	Flagset.Usage = func() {
 		os.Stderr.WriteString(strings.Join([]string{
@@ -42,6 +81,9 @@ func main() {
 			"arguments:",
 			"  - client mode",
 			"        <source-url> [-|<local-file>|<target-url>]",
+			"        <local-file> <target-url>",
+			"        -manifest <manifest-file>",
+			"        -recursive <source-folder-url> <local-folder>",
 			"  - server mode",
 			"        [<local-folder>]",
 			"",
@@ -52,24 +94,101 @@ func main() {
 	}
 	Flagset.BoolVar(&Version, "version", Version, "show program version and exit")
 	Flagset.IntVar(&Concurrency, "concurrency", Concurrency, "set transfer concurrency level")
+	Flagset.BoolVar(&Adaptive, "adaptive", Adaptive, "adjust transfer concurrency level to measured bandwidth, up to -concurrency (default false)")
 	Flagset.IntVar(&Maxmem, "maxmem", Maxmem, "set maximum memory used for in-memory transfers")
 	Flagset.IntVar(&Timeout, "timeout", Timeout, "set requests timeout")
+	Flagset.IntVar(&Retries, "retries", Retries, "set maximum retries per chunk before aborting")
 	Flagset.Var(&Source, "source", "add HTTP header to source request (repeatable, no default)")
+	Flagset.StringVar(&Ratelimit, "ratelimit", Ratelimit, `limit transfer bandwidth in client mode (e.g. "500Mb/s", or "@<file>" reloaded on SIGHUP, no default)`)
+	Flagset.StringVar(&Onchange, "onchange", Onchange, `set policy when source changes during transfer in client mode ("abort" or "restart")`)
+	Flagset.Var(&Mirrors, "mirror", "add alternate source URL for the same document (repeatable, no default)")
 	Flagset.Var(&Target, "target", "add HTTP header to target request (repeatable, no default)")
 	Flagset.BoolVar(&Post, "post", Post, "use HTTP POST method for remote target (default PUT)")
+	Flagset.StringVar(&ClientCert, "client-certificate", ClientCert, "present provided TLS client certificate in client mode (no default)")
+	Flagset.StringVar(&ClientKey, "client-key", ClientKey, "use provided TLS client certificate key in client mode (default -client-certificate)")
+	Flagset.StringVar(&CA, "ca", CA, "verify remote TLS certificates against provided CA bundle in client mode (default system bundle)")
+	Flagset.StringVar(&Pin, "pin", Pin, `accept only remote TLS certificates (or public keys) with provided comma-separated SHA-256 fingerprints in client mode (no default)`)
 	Flagset.BoolVar(&Insecure, "insecure", Insecure, "ignore remote TLS certificate errors (default false)")
 	Flagset.BoolVar(&Noresume, "noresume", Noresume, "disable transfer auto-resuming (default false)")
 	Flagset.BoolVar(&Verbose, "verbose", Verbose, "set verbose mode (default false)")
 	Flagset.BoolVar(&Dump, "dump", Dump, "dump HTTP requests and responses (default false)")
 	Flagset.BoolVar(&Progress, "progress", Progress, "emit transfer progress JSON indications (default false)")
+	Flagset.StringVar(&Verify, "verify", Verify, `verify transfered document digest in client mode ("sha256" or "tree", no default)`)
+	Flagset.StringVar(&Manifest, "manifest", Manifest, `transfer all documents listed in provided file in client mode (or "-" for standard input, no default)`)
+	Flagset.IntVar(&Parallel, "parallel", Parallel, "set number of documents transfered simultaneously in manifest mode")
+	Flagset.BoolVar(&Recursive, "recursive", Recursive, "serve sub-folders in server mode, or mirror remote folder in client mode (default false)")
 	Flagset.StringVar(&Listen, "listen", Listen, "set listening address & port in server mode (default client mode)")
-	Flagset.StringVar(&Certificate, "certificate", Certificate, `use provided TLS certificate & key in server mode (or "internal", no default)`)
+	Flagset.Var(&Certificate, "certificate", `use provided TLS certificate & key in server mode, optionally for a SNI hostname (or "internal", repeatable, no default)`)
+	Flagset.StringVar(&ClientCA, "client-ca", ClientCA, "require TLS client certificates signed by provided CA bundle in server mode (no default)")
+	Flagset.StringVar(&ClientID, "client-identity", ClientID, `map TLS client certificate to requests identity in server mode ("cn" or "san", no default)`)
+	Flagset.IntVar(&Drain, "drain", Drain, "set maximum delay to complete in-flight requests on shutdown in server mode")
 	Flagset.StringVar(&Password, "password", Password, "set security password in server mode (no default)")
+	Flagset.StringVar(&Users, "users", Users, "authenticate users and map them to their own folders from provided file in server mode (reloaded on SIGHUP, no default)")
+	Flagset.StringVar(&Secret, "secret", Secret, `set signed URLs secret in server mode, or sign URL with -sign in client mode (or "@<file>", no default)`)
+	Flagset.StringVar(&Sign, "sign", Sign, `print signed URL in client mode ("<validity>[,<path-scope>[,<client-ip>]]", e.g. "24h,/releases/", no default)`)
+	Flagset.BoolVar(&Writable, "writable", Writable, "accept uploads into local folder in server mode (default false)")
+	Flagset.StringVar(&Egress, "egress", Egress, `limit egress bandwidth in server mode ("<global>[,<per-client>]", e.g. "1Gb/s,200Mb/s", no default)`)
+	Flagset.StringVar(&Metrics, "metrics", Metrics, "expose Prometheus metrics on provided address & port in server mode (no default)")
+	Flagset.StringVar(&Accesslog, "accesslog", Accesslog, `write access log to provided file in server mode (reopened on SIGHUP, or "-" for standard output, no default)`)
+	Flagset.StringVar(&Logformat, "logformat", Logformat, `set access log format in server mode ("json", "common" or "combined")`)
+	Flagset.BoolVar(&Digest, "digest", Digest, "compute and advertise files digests in server mode (default false)")
 	Flagset.Parse(os.Args[1:])
+	if Adaptive {
+		explicit := false
+		Flagset.Visit(func(option *flag.Flag) {
+			explicit = explicit || option.Name == "concurrency"
+		})
+		if !explicit {
+			Concurrency = 32
+		}
+	}
 	Concurrency = min(32, max(1, Concurrency))
 	Maxmem = (max(Concurrency*8<<20, Maxmem) / Concurrency) * Concurrency
 	Timeout = min(30, max(1, Timeout))
-	Listen, Certificate, Password = strings.TrimLeft(strings.TrimSpace(Listen), "*"), strings.TrimSpace(Certificate), strings.TrimSpace(Password)
+	Retries = min(100, max(0, Retries))
+	Parallel = min(64, max(1, Parallel))
+	Drain = min(3600, max(0, Drain))
+	Manifest, Ratelimit, Egress, Metrics = strings.TrimSpace(Manifest), strings.TrimSpace(Ratelimit), strings.TrimSpace(Egress), strings.TrimLeft(strings.TrimSpace(Metrics), "*")
+	Listen, Password = strings.TrimLeft(strings.TrimSpace(Listen), "*"), strings.TrimSpace(Password)
+	switch strings.ToLower(strings.TrimSpace(Verify)) {
+	case "":
+		Verify = ""
+
+	case "sha256", "sha-256":
+		Verify = transfer.DigestLinear
+
+	case "tree", "sha256-tree", "sha-256-tree":
+		Verify = transfer.DigestTree
+
+	default:
+		os.Stderr.WriteString("invalid digest algorithm " + Verify + " - aborting\n")
+		os.Exit(1)
+	}
+
+	if Logformat = strings.ToLower(strings.TrimSpace(Logformat)); Logformat != "json" && Logformat != "common" && Logformat != "combined" {
+		os.Stderr.WriteString("invalid access log format " + Logformat + " - aborting\n")
+		os.Exit(1)
+	}
+	Accesslog, Users = strings.TrimSpace(Accesslog), strings.TrimSpace(Users)
+	ClientCert, ClientKey, ClientCA = strings.TrimSpace(ClientCert), strings.TrimSpace(ClientKey), strings.TrimSpace(ClientCA)
+	CA, Pin = strings.TrimSpace(CA), strings.TrimSpace(Pin)
+	if ClientID = strings.ToLower(strings.TrimSpace(ClientID)); ClientID != "" && ClientID != "cn" && ClientID != "san" {
+		os.Stderr.WriteString("invalid client identity mapping " + ClientID + " - aborting\n")
+		os.Exit(1)
+	}
+	if Secret, Sign = strings.TrimSpace(Secret), strings.TrimSpace(Sign); strings.HasPrefix(Secret, "@") {
+		content, err := os.ReadFile(Secret[1:])
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + " - aborting\n")
+			os.Exit(1)
+		}
+		Secret = strings.TrimSpace(string(content))
+	}
+
+	if Onchange = strings.ToLower(strings.TrimSpace(Onchange)); Onchange != "abort" && Onchange != "restart" {
+		os.Stderr.WriteString("invalid source change policy " + Onchange + " - aborting\n")
+		os.Exit(1)
+	}
 
 	if Version {
 		os.Stdout.WriteString(PROGNAME + " v" + PROGVER + "\n")
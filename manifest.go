@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyke369/mfetch/transfer"
+)
+
+type manifestEntry struct {
+	Source   string   `json:"source"`
+	Target   string   `json:"target"`
+	Mirrors  []string `json:"mirrors"`
+	modified int64
+}
+
+func manifestLoad(path string) (entries []manifestEntry, err error) {
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	scanner, line := bufio.NewScanner(reader), 0
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line++
+		value := strings.TrimSpace(scanner.Text())
+		if value == "" || value[0] == '#' {
+			continue
+		}
+		entry := manifestEntry{}
+		if value[0] == '{' {
+			if err := json.Unmarshal([]byte(value), &entry); err != nil {
+				return nil, errors.New(path + ":" + strconv.Itoa(line) + ": " + err.Error())
+			}
+
+		} else {
+			fields := strings.Fields(value)
+			if len(fields) > 2 {
+				return nil, errors.New(path + ":" + strconv.Itoa(line) + ": too many fields")
+			}
+			entry.Source = fields[0]
+			if len(fields) > 1 {
+				entry.Target = fields[1]
+			}
+		}
+		if entry.Source = strings.TrimSpace(entry.Source); entry.Source == "" {
+			return nil, errors.New(path + ":" + strconv.Itoa(line) + ": missing source")
+		}
+		entry.Target = strings.TrimSpace(entry.Target)
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New(path + ": no transfer found")
+	}
+	return entries, nil
+}
+
+func clientManifest() {
+	entries, err := manifestLoad(Manifest)
+	if err != nil {
+		clientAbort(1, err.Error())
+	}
+	clientBatch(entries)
+}
+
+func clientBatch(entries []manifestEntry) {
+	clientSlots = make(chan struct{}, Concurrency)
+
+	var (
+		lock                        sync.Mutex
+		active                      = map[*transfer.Transfer]bool{}
+		completed, failed, received int64
+	)
+	total := func() (value int64) {
+		lock.Lock()
+		value = received
+		for t := range active {
+			value += t.Status().Received
+		}
+		lock.Unlock()
+		return
+	}
+
+	start, queue, waiter1, waiter2, done := time.Now(), make(chan manifestEntry), sync.WaitGroup{}, sync.WaitGroup{}, make(chan bool, 1)
+	waiter1.Add(1)
+	go func() {
+		previous, bandwidth, finished := int64(0), float64(0), false
+		for {
+			value := total()
+			if finished {
+				bandwidth = float64(value*8) / (float64(time.Since(start)) / float64(time.Second))
+
+			} else {
+				bandwidth, previous = float64((value-previous)*8), value
+			}
+			lock.Lock()
+			running := len(active)
+			lock.Unlock()
+			if Verbose {
+				os.Stderr.WriteString("\r" + strconv.FormatInt(atomic.LoadInt64(&completed)+atomic.LoadInt64(&failed), 10) + "/" + strconv.Itoa(len(entries)) +
+					" | " + strconv.Itoa(running) +
+					" | " + utilSize(value) +
+					" | " + utilBandwidth(bandwidth) + clientCap(false) +
+					" | " + utilDuration(int(time.Since(start)/time.Second)) +
+					"     ")
+				if finished {
+					os.Stderr.WriteString("\n")
+				}
+			}
+			if Progress {
+				event := "progress"
+				if finished {
+					event = "summary"
+				}
+				os.Stdout.WriteString(`{"event":"` + event +
+					`","files":` + strconv.Itoa(len(entries)) +
+					`,"active":` + strconv.Itoa(running) +
+					`,"completed":` + strconv.FormatInt(atomic.LoadInt64(&completed), 10) +
+					`,"failed":` + strconv.FormatInt(atomic.LoadInt64(&failed), 10) +
+					`,"received":` + strconv.FormatInt(value, 10) +
+					`,"bandwidth":"` + utilBandwidth(bandwidth) +
+					`","elapsed":` + strconv.FormatFloat(float64(time.Since(start))/float64(time.Second), 'f', 2, 64) + clientCap(true) + "}\n")
+			}
+			if finished {
+				break
+			}
+			select {
+			case <-done:
+				finished = true
+
+			case <-time.After(time.Second):
+			}
+		}
+		waiter1.Done()
+	}()
+
+	for worker := 0; worker < min(Parallel, len(entries)); worker++ {
+		waiter2.Add(1)
+		go func() {
+			for entry := range queue {
+				if Progress {
+					os.Stdout.WriteString(`{"event":"start","source":` + strconv.Quote(entry.Source) + `,"target":` + strconv.Quote(entry.Target) + "}\n")
+				}
+				var current *transfer.Transfer
+				begin := time.Now()
+				t, err := clientRun(entry.Source, entry.Target, entry.Mirrors, true, func(t *transfer.Transfer) {
+					lock.Lock()
+					if current != nil {
+						delete(active, current)
+						received += current.Status().Received
+					}
+					current, active[t] = t, true
+					lock.Unlock()
+				})
+				lock.Lock()
+				if t != nil {
+					delete(active, t)
+					received += t.Status().Received
+				}
+				lock.Unlock()
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					if Verbose {
+						os.Stderr.WriteString("\r                                                       \r")
+					}
+					os.Stderr.WriteString(entry.Source + " - " + err.Error() + "\n")
+					if Progress {
+						os.Stdout.WriteString(`{"event":"error"` + clientLabel(entry.Source, entry.Target, true) + `,"code":` + strconv.Itoa(clientCode(err)) + `,"message":` + strconv.Quote(err.Error()) + "}\n")
+					}
+					continue
+				}
+				if entry.modified != 0 {
+					os.Chtimes(entry.Target, time.Unix(entry.modified, 0), time.Unix(entry.modified, 0))
+				}
+				atomic.AddInt64(&completed, 1)
+				if Progress {
+					status := t.Status()
+					os.Stdout.WriteString(`{"event":"end"` + clientLabel(entry.Source, entry.Target, true) +
+						`,"concurrency":` + strconv.Itoa(status.Concurrency) +
+						`,"size":` + strconv.FormatInt(status.Size, 10) +
+						`,"received":` + strconv.FormatInt(status.Received, 10) +
+						`,"retries":` + strconv.FormatInt(status.Retries, 10) +
+						`,"elapsed":` + strconv.FormatFloat(float64(time.Since(begin))/float64(time.Second), 'f', 2, 64) + "}\n")
+				}
+			}
+			waiter2.Done()
+		}()
+	}
+feed:
+	for _, entry := range entries {
+		select {
+		case queue <- entry:
+
+		case <-clientContext.Done():
+			break feed
+		}
+	}
+	close(queue)
+	waiter2.Wait()
+	done <- true
+	waiter1.Wait()
+	if clientContext.Err() != nil {
+		os.Exit(8)
+	}
+	if failed != 0 {
+		os.Exit(6)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyke369/golang-support/auth"
+	l "github.com/pyke369/golang-support/listener"
+)
+
+var (
+	metricsBuckets   = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+	metricsRequests  = map[[3]string]int64{}
+	metricsDurations = map[string]*metricsHistogram{}
+	metricsFiles     = map[[2]string]*metricsFile{}
+	metricsThrottled = time.Duration(0)
+	metricsLock      sync.Mutex
+	metricsEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type metricsHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+type metricsFile struct {
+	transfers int64
+	sent      int64
+}
+
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodOptions, http.MethodHead, http.MethodGet, http.MethodPut, http.MethodPost:
+		return method
+	}
+	return "OTHER"
+}
+
+func metricsReject(method, user string, status int) {
+	if Metrics == "" {
+		return
+	}
+	metricsLock.Lock()
+	metricsRequests[[3]string{metricsMethod(method), strconv.Itoa(status), user}]++
+	metricsLock.Unlock()
+}
+
+func metricsRecord(method, user, path string, status int, sent int64, elapsed, throttled time.Duration) {
+	if Metrics == "" {
+		return
+	}
+	method = metricsMethod(method)
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricsRequests[[3]string{method, strconv.Itoa(status), user}]++
+	histogram := metricsDurations[method]
+	if histogram == nil {
+		histogram = &metricsHistogram{counts: make([]int64, len(metricsBuckets))}
+		metricsDurations[method] = histogram
+	}
+	seconds := elapsed.Seconds()
+	for index, bucket := range metricsBuckets {
+		if seconds <= bucket {
+			histogram.counts[index]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+	metricsThrottled += throttled
+
+	// only count actual files transfers (no listing, no virtual files), with a bounded number of series
+	if method == http.MethodGet && (status == http.StatusOK || status == http.StatusPartialContent) && Flagset.NArg() > 0 && !strings.HasSuffix(path, "/") {
+		key := [2]string{path, user}
+		file := metricsFiles[key]
+		if file == nil {
+			if len(metricsFiles) >= 10<<10 {
+				return
+			}
+			file = &metricsFile{}
+			metricsFiles[key] = file
+		}
+		file.transfers++
+		file.sent += sent
+	}
+}
+
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if Password != "" {
+			_, received, _ := request.BasicAuth()
+			if match, _ := auth.Password(received, []string{Password}, false); !match {
+				response.Header().Set("WWW-Authenticate", `Basic realm="`+PROGNAME+`"`)
+				response.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		output := &strings.Builder{}
+		output.WriteString("# HELP " + PROGNAME + "_build_info Program version.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_build_info gauge\n")
+		output.WriteString(PROGNAME + `_build_info{version="` + PROGVER + `"} 1` + "\n")
+		output.WriteString("# HELP " + PROGNAME + "_inflight_requests Requests currently being served.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_inflight_requests gauge\n")
+		output.WriteString(PROGNAME + "_inflight_requests " + strconv.FormatInt(atomic.LoadInt64(&serverInflight), 10) + "\n")
+		output.WriteString("# HELP " + PROGNAME + "_sent_bytes_total Bytes sent in responses bodies.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_sent_bytes_total counter\n")
+		output.WriteString(PROGNAME + "_sent_bytes_total " + strconv.FormatInt(atomic.LoadInt64(&serverSent), 10) + "\n")
+		output.WriteString("# HELP " + PROGNAME + "_received_bytes_total Bytes received in uploads bodies.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_received_bytes_total counter\n")
+		output.WriteString(PROGNAME + "_received_bytes_total " + strconv.FormatInt(atomic.LoadInt64(&serverReceived), 10) + "\n")
+
+		output.WriteString("# HELP " + PROGNAME + "_dropped_messages_total Log messages dropped because of a full queue.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_dropped_messages_total counter\n")
+		output.WriteString(PROGNAME + `_dropped_messages_total{log="access"} ` + strconv.FormatInt(atomic.LoadInt64(&accessDropped), 10) + "\n")
+		output.WriteString(PROGNAME + `_dropped_messages_total{log="dump"} ` + strconv.FormatInt(atomic.LoadInt64(&serverDropped), 10) + "\n")
+
+		metricsLock.Lock()
+		output.WriteString("# HELP " + PROGNAME + "_throttled_seconds_total Time spent waiting for egress limits.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_throttled_seconds_total counter\n")
+		output.WriteString(PROGNAME + "_throttled_seconds_total " + strconv.FormatFloat(metricsThrottled.Seconds(), 'f', 3, 64) + "\n")
+
+		keys := make([][3]string, 0, len(metricsRequests))
+		for key := range metricsRequests {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return strings.Join(keys[i][:], "\n") < strings.Join(keys[j][:], "\n")
+		})
+		output.WriteString("# HELP " + PROGNAME + "_requests_total Requests served by method, status and user.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_requests_total counter\n")
+		for _, key := range keys {
+			output.WriteString(PROGNAME + `_requests_total{method="` + key[0] + `",status="` + key[1] + `",user="` + metricsEscaper.Replace(key[2]) + `"} ` + strconv.FormatInt(metricsRequests[key], 10) + "\n")
+		}
+
+		methods := make([]string, 0, len(metricsDurations))
+		for method := range metricsDurations {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		output.WriteString("# HELP " + PROGNAME + "_request_duration_seconds Requests duration by method.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_request_duration_seconds histogram\n")
+		for _, method := range methods {
+			histogram := metricsDurations[method]
+			for index, bucket := range metricsBuckets {
+				output.WriteString(PROGNAME + `_request_duration_seconds_bucket{method="` + method + `",le="` + strconv.FormatFloat(bucket, 'g', -1, 64) + `"} ` + strconv.FormatInt(histogram.counts[index], 10) + "\n")
+			}
+			output.WriteString(PROGNAME + `_request_duration_seconds_bucket{method="` + method + `",le="+Inf"} ` + strconv.FormatInt(histogram.count, 10) + "\n")
+			output.WriteString(PROGNAME + `_request_duration_seconds_sum{method="` + method + `"} ` + strconv.FormatFloat(histogram.sum, 'f', 6, 64) + "\n")
+			output.WriteString(PROGNAME + `_request_duration_seconds_count{method="` + method + `"} ` + strconv.FormatInt(histogram.count, 10) + "\n")
+		}
+
+		paths := make([][2]string, 0, len(metricsFiles))
+		for key := range metricsFiles {
+			paths = append(paths, key)
+		}
+		sort.Slice(paths, func(i, j int) bool {
+			return paths[i][0] < paths[j][0] || (paths[i][0] == paths[j][0] && paths[i][1] < paths[j][1])
+		})
+		output.WriteString("# HELP " + PROGNAME + "_file_transfers_total Successful download requests by file.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_file_transfers_total counter\n")
+		for _, path := range paths {
+			output.WriteString(PROGNAME + `_file_transfers_total{path="` + metricsEscaper.Replace(path[0]) + `",user="` + metricsEscaper.Replace(path[1]) + `"} ` + strconv.FormatInt(metricsFiles[path].transfers, 10) + "\n")
+		}
+		output.WriteString("# HELP " + PROGNAME + "_file_sent_bytes_total Bytes sent by file.\n")
+		output.WriteString("# TYPE " + PROGNAME + "_file_sent_bytes_total counter\n")
+		for _, path := range paths {
+			output.WriteString(PROGNAME + `_file_sent_bytes_total{path="` + metricsEscaper.Replace(path[0]) + `",user="` + metricsEscaper.Replace(path[1]) + `"} ` + strconv.FormatInt(metricsFiles[path].sent, 10) + "\n")
+		}
+		metricsLock.Unlock()
+
+		response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		response.Write([]byte(output.String()))
+	})
+}
+
+func metricsServe() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	server := &http.Server{
+		Handler:           mux,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ReadTimeout:       time.Duration(Timeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(Timeout) * time.Second,
+		IdleTimeout:       time.Duration(Timeout) * time.Second * 2,
+	}
+	for {
+		if listener, err := l.NewTCPListener("tcp", Metrics, &l.TCPOptions{ReusePort: true}); err == nil {
+			server.Serve(listener)
+		}
+		time.Sleep(time.Second)
+	}
+}
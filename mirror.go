@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pyke369/mfetch/transfer"
+)
+
+type mirrorEntry struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+func mirrorList(source string) (entries []mirrorEntry, err error) {
+	request, err := http.NewRequestWithContext(clientContext, http.MethodGet, source, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", PROGNAME+"/"+PROGVER)
+	request.Header.Set("Accept", "application/json")
+	transfer.SetHeaders(request, clientHeaders(Source))
+	response, err := clientClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("source http status " + strconv.Itoa(response.StatusCode))
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<30)).Decode(&entries); err != nil {
+		return nil, errors.New("invalid source listing (" + err.Error() + ")")
+	}
+	return entries, nil
+}
+
+func clientMirror(source, target string) {
+	if target == "" || target == "-" || strings.HasPrefix(target, "http") {
+		clientAbort(1, "recursive mode requires a local target folder")
+	}
+	base, err := url.Parse(source)
+	if err != nil {
+		clientAbort(1, err.Error())
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		base.RawPath = ""
+	}
+	listing, err := mirrorList(base.String())
+	if err != nil {
+		clientAbort(1, err.Error())
+	}
+
+	entries := []manifestEntry{}
+	for _, entry := range listing {
+		name := filepath.FromSlash(entry.Name)
+		if !filepath.IsLocal(name) || strings.HasPrefix(entry.Name, ".") || strings.Contains(entry.Name, "/.") {
+			continue
+		}
+		local, remote := filepath.Join(target, name), *base
+		remote.Path, remote.RawPath = path.Join(base.Path, entry.Name), ""
+		if info, err := os.Stat(local); err == nil && info.Mode().IsRegular() && info.Size() == entry.Size && info.ModTime().Unix() == entry.Modified {
+			if _, err := os.Stat(transfer.ResumePath(local)); err != nil {
+				if Progress {
+					os.Stdout.WriteString(`{"event":"skip","source":` + strconv.Quote(remote.String()) + `,"target":` + strconv.Quote(local) + "}\n")
+				}
+				continue
+			}
+		}
+		entries = append(entries, manifestEntry{Source: remote.String(), Target: local, modified: entry.Modified})
+	}
+	clientBatch(entries)
+}
@@ -1,20 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pyke369/golang-support/auth"
@@ -22,6 +39,7 @@ import (
 	l "github.com/pyke369/golang-support/listener"
 	"github.com/pyke369/golang-support/rcache"
 	"github.com/pyke369/golang-support/ustr"
+	"github.com/pyke369/mfetch/transfer"
 )
 
 var (
@@ -29,13 +47,42 @@ var (
 	serverId       = int64(0)
 	serverInflight = int64(0)
 	serverSent     = int64(0)
+	serverReceived = int64(0)
 	serverMessages = make(chan string, 1<<10)
+	serverDropped  = int64(0)
+	serverDigests  = map[string]*serverDigest{}
+	serverDQueue   = make(chan struct{}, 1)
+	serverDSlots   = make(chan struct{}, 4)
+	serverULock    sync.Mutex
+	serverDSync    = int64(16 << 20)
+	serverLock     sync.Mutex
+	serverEgress   = &transfer.Limiter{}
+	serverClient   = float64(0)
+	serverClients  = map[string]*serverLimiter{}
+	serverReadyEnv = strings.ToUpper(PROGNAME) + "_READY"
 )
 
+type serverLimiter struct {
+	limiter *transfer.Limiter
+	refs    int
+}
+
+type serverDigest struct {
+	size     int64
+	modified time.Time
+	value    string
+	linear   []byte
+	tree     []byte
+	ready    chan struct{}
+}
+
 type serverWriter struct {
-	rw     http.ResponseWriter
-	status int
-	sent   int64
+	rw        http.ResponseWriter
+	context   context.Context
+	limiters  []*transfer.Limiter
+	status    int
+	sent      int64
+	throttled time.Duration
 }
 
 func (sw *serverWriter) Header() http.Header {
@@ -46,9 +93,162 @@ func (sw *serverWriter) WriteHeader(status int) {
 	sw.rw.WriteHeader(status)
 }
 func (sw *serverWriter) Write(data []byte) (n int, err error) {
-	sw.sent += int64(len(data))
-	atomic.AddInt64(&serverSent, int64(len(data)))
-	return sw.rw.Write(data)
+	if len(sw.limiters) == 0 {
+		sw.sent += int64(len(data))
+		atomic.AddInt64(&serverSent, int64(len(data)))
+		return sw.rw.Write(data)
+	}
+	for len(data) > 0 {
+		size, start := min(len(data), 64<<10), time.Now()
+		for _, limiter := range sw.limiters {
+			if err := limiter.Wait(sw.context, size); err != nil {
+				return n, err
+			}
+		}
+		if elapsed := time.Since(start); elapsed >= time.Millisecond {
+			sw.throttled += elapsed
+		}
+		written, err := sw.rw.Write(data[:size])
+		n += written
+		sw.sent += int64(written)
+		atomic.AddInt64(&serverSent, int64(written))
+		if err != nil {
+			return n, err
+		}
+		data = data[size:]
+	}
+	return n, nil
+}
+func (sw *serverWriter) Unwrap() http.ResponseWriter {
+	return sw.rw
+}
+
+func serverMessage(message string) {
+	select {
+	case serverMessages <- message:
+
+	default:
+		atomic.AddInt64(&serverDropped, 1)
+	}
+}
+
+func serverSigned(request *http.Request) (signed, valid bool) {
+	query := request.URL.Query()
+	signature := query.Get("signature")
+	if Secret == "" || signature == "" {
+		return false, false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return true, false
+	}
+	scope := query.Get("scope")
+	if scope != "" && (!strings.HasSuffix(scope, "/") || !strings.HasPrefix(request.URL.Path, scope)) {
+		return true, false
+	}
+	address := query.Get("ip")
+	if address != "" {
+		host, _, _ := net.SplitHostPort(request.RemoteAddr)
+		if host != address {
+			return true, false
+		}
+	}
+	return true, hmac.Equal([]byte(signature), []byte(utilSignature(Secret, request.URL.Path, scope, expires, address)))
+}
+
+func serverIdentity(request *http.Request) string {
+	if ClientID == "" || request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	certificate := request.TLS.PeerCertificates[0]
+	if ClientID == "cn" {
+		return certificate.Subject.CommonName
+	}
+	switch {
+	case len(certificate.DNSNames) != 0:
+		return certificate.DNSNames[0]
+
+	case len(certificate.EmailAddresses) != 0:
+		return certificate.EmailAddresses[0]
+
+	case len(certificate.URIs) != 0:
+		return certificate.URIs[0].String()
+
+	case len(certificate.IPAddresses) != 0:
+		return certificate.IPAddresses[0].String()
+	}
+	return ""
+}
+
+func serverHandoff() error {
+	executable, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	command := exec.Command(executable, os.Args[1:]...)
+	command.Stdin, command.Stdout, command.Stderr = os.Stdin, os.Stdout, os.Stderr
+	command.Env, command.ExtraFiles = append(os.Environ(), serverReadyEnv+"=3"), []*os.File{writer}
+	err = command.Start()
+	writer.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := reader.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(10 * time.Second):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		command.Process.Kill()
+		command.Wait()
+		return errors.New("new instance failed to start (" + err.Error() + ")")
+	}
+	command.Process.Release()
+	return nil
+}
+
+func serverReady() {
+	if os.Getenv(serverReadyEnv) != "" {
+		os.Unsetenv(serverReadyEnv)
+		if file := os.NewFile(3, "ready"); file != nil {
+			file.Write([]byte{1})
+			file.Close()
+		}
+	}
+}
+
+func serverAcquire(key string) *transfer.Limiter {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	entry := serverClients[key]
+	if entry == nil {
+		entry = &serverLimiter{limiter: &transfer.Limiter{}}
+		entry.limiter.Set(serverClient)
+		serverClients[key] = entry
+	}
+	entry.refs++
+	return entry.limiter
+}
+
+func serverRelease(key string) {
+	serverLock.Lock()
+	if entry := serverClients[key]; entry != nil {
+		if entry.refs--; entry.refs <= 0 {
+			delete(serverClients, key)
+		}
+	}
+	serverLock.Unlock()
 }
 
 func serverSimulate() http.Handler {
@@ -115,40 +315,498 @@ func serverSimulate() http.Handler {
 	})
 }
 
+func serverDigestLookup(path string, info os.FileInfo) (entry *serverDigest) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	if entry = serverDigests[path]; entry != nil && entry.size == info.Size() && entry.modified.Equal(info.ModTime()) {
+		return entry
+	}
+	entry = &serverDigest{size: info.Size(), modified: info.ModTime(), ready: make(chan struct{})}
+	serverDigests[path] = entry
+	go func() {
+		defer close(entry.ready)
+		queue := serverDSlots
+		if entry.size > serverDSync {
+			queue = serverDQueue
+		}
+		queue <- struct{}{}
+		linear, tree, err := transfer.DigestFile(path)
+		<-queue
+		info, serr := os.Stat(path)
+		serverLock.Lock()
+		if err == nil && serr == nil && info.Size() == entry.size && info.ModTime().Equal(entry.modified) {
+			entry.linear, entry.tree = linear, tree
+			entry.value = transfer.DigestLinear + "=:" + base64.StdEncoding.EncodeToString(linear) + ":, " +
+				transfer.DigestTree + "=:" + base64.StdEncoding.EncodeToString(tree) + ":"
+
+		} else if serverDigests[path] == entry {
+			delete(serverDigests, path)
+		}
+		serverLock.Unlock()
+	}()
+	return entry
+}
+
+func serverDigestCached(path string, info os.FileInfo) (linear, tree []byte) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	if entry := serverDigests[path]; entry != nil && entry.size == info.Size() && entry.modified.Equal(info.ModTime()) {
+		return entry.linear, entry.tree
+	}
+	return nil, nil
+}
+
+func serverDigestPrune() {
+	for {
+		time.Sleep(time.Minute)
+		serverLock.Lock()
+		entries := make(map[string]*serverDigest, len(serverDigests))
+		for path, entry := range serverDigests {
+			entries[path] = entry
+		}
+		serverLock.Unlock()
+		for path, entry := range entries {
+			if info, err := os.Stat(path); err != nil || info.Size() != entry.size || !info.ModTime().Equal(entry.modified) {
+				serverLock.Lock()
+				if serverDigests[path] == entry {
+					delete(serverDigests, path)
+				}
+				serverLock.Unlock()
+			}
+		}
+	}
+}
+
+func serverDigester(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		path := filepath.Join(root, filepath.FromSlash(request.URL.Path))
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			entry := serverDigestLookup(path, info)
+			if entry.size <= serverDSync {
+				select {
+				case <-entry.ready:
+				case <-request.Context().Done():
+				}
+			}
+			serverLock.Lock()
+			if entry.value != "" {
+				response.Header().Set("Repr-Digest", entry.value)
+			}
+			serverLock.Unlock()
+		}
+		handler.ServeHTTP(response, request)
+	})
+}
+
+func serverTag(info os.FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + `"`
+}
+
+func serverLister(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !strings.HasSuffix(request.URL.Path, "/") || (request.Method != http.MethodGet && request.Method != http.MethodHead) {
+			if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(request.URL.Path))); err == nil && info.Mode().IsRegular() {
+				response.Header().Set("Etag", serverTag(info))
+			}
+			handler.ServeHTTP(response, request)
+			return
+		}
+
+		folder := filepath.Join(root, filepath.FromSlash(request.URL.Path))
+		if info, err := os.Stat(folder); err != nil || !info.IsDir() {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ndjson := request.URL.Query().Get("format") == "ndjson" || strings.Contains(request.Header.Get("Accept"), "application/x-ndjson")
+		if ndjson {
+			response.Header().Set("Content-Type", "application/x-ndjson")
+
+		} else {
+			response.Header().Set("Content-Type", "application/json")
+		}
+		response.Header().Set("Cache-Control", "no-store")
+		if request.Method == http.MethodHead {
+			return
+		}
+
+		writer, count := bufio.NewWriterSize(response, 64<<10), 0
+		if !ndjson {
+			writer.WriteString("[")
+		}
+		filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || path == folder {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") || (entry.IsDir() && !Recursive) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			name, _ := filepath.Rel(folder, path)
+			item := map[string]any{"name": filepath.ToSlash(name), "size": info.Size(), "modified": info.ModTime().Unix(), "etag": serverTag(info)}
+			if Digest {
+				if linear, tree := serverDigestCached(path, info); linear != nil {
+					item["digest"] = map[string]string{transfer.DigestLinear: hex.EncodeToString(linear), transfer.DigestTree: hex.EncodeToString(tree)}
+				}
+			}
+			payload, _ := json.Marshal(item)
+			if ndjson {
+				writer.Write(append(payload, '\n'))
+
+			} else {
+				if count != 0 {
+					writer.WriteString(",")
+				}
+				writer.Write(payload)
+			}
+			count++
+			return nil
+		})
+		if !ndjson {
+			writer.WriteString("]\n")
+		}
+		writer.Flush()
+	})
+}
+
+func serverStore(response http.ResponseWriter, request *http.Request, path string) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.upload")
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	temporary := file.Name()
+	defer func() {
+		file.Close()
+		os.Remove(temporary)
+	}()
+
+	dlinear, dtree := transfer.NewDigest(transfer.DigestLinear), transfer.NewDigest(transfer.DigestTree)
+	controller, data, offset := http.NewResponseController(response), make([]byte, 64<<10), int64(0)
+	for {
+		if controller.SetReadDeadline(time.Now().Add(time.Duration(Timeout)*time.Second)) != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		read, err := request.Body.Read(data)
+		if read > 0 {
+			if _, err := file.Write(data[:read]); err != nil {
+				response.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			dlinear.Write(data[:read], offset)
+			dtree.Write(data[:read], offset)
+			atomic.AddInt64(&serverReceived, int64(read))
+			offset += int64(read)
+		}
+		if err != nil {
+			if err != io.EOF {
+				response.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			break
+		}
+	}
+	if request.ContentLength >= 0 && offset != request.ContentLength {
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if digests := transfer.ParseDigests(request.Header.Values("Repr-Digest")...); len(digests) != 0 {
+		linear, _ := dlinear.Sum(nil, offset)
+		tree, _ := dtree.Sum(nil, offset)
+		if (digests[transfer.DigestLinear] != nil && !bytes.Equal(digests[transfer.DigestLinear], linear)) || (digests[transfer.DigestTree] != nil && !bytes.Equal(digests[transfer.DigestTree], tree)) {
+			response.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	status := http.StatusCreated
+	if _, err := os.Stat(path); err == nil {
+		status = http.StatusNoContent
+	}
+	if file.Chmod(0o644) != nil || file.Sync() != nil || os.Rename(temporary, path) != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response.WriteHeader(status)
+}
+
+func serverRangesLoad(path string, size int64) (ranges [][2]int64) {
+	var state struct {
+		Size   int64      `json:"size"`
+		Ranges [][2]int64 `json:"ranges"`
+	}
+	if payload, err := os.ReadFile(path); err == nil && json.Unmarshal(payload, &state) == nil && state.Size == size {
+		return state.Ranges
+	}
+	return nil
+}
+
+func serverRangesAdd(path string, size, start, end int64) error {
+	serverULock.Lock()
+	defer serverULock.Unlock()
+	ranges := [][2]int64{}
+	for _, value := range serverRangesLoad(path, size) {
+		if value[1]+1 < start || value[0] > end+1 {
+			ranges = append(ranges, value)
+			continue
+		}
+		start, end = min(start, value[0]), max(end, value[1])
+	}
+	ranges = append(ranges, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+	payload, _ := json.Marshal(map[string]any{"size": size, "ranges": ranges})
+	return transfer.WriteFile(path, payload, 0o644)
+}
+
+func serverReceiver(root string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPut && request.Method != http.MethodPost {
+			handler.ServeHTTP(response, request)
+			return
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(request.URL.Path))
+		temporary := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".upload")
+		received := temporary + ".ranges"
+		if strings.HasSuffix(request.URL.Path, "/") {
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if Recursive {
+			if os.MkdirAll(filepath.Dir(path), 0o755) != nil {
+				response.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+		if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+			response.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if captures := rcache.Get(`^bytes \*/(\d+)$`).FindStringSubmatch(request.Header.Get("Content-Range")); captures != nil {
+			size, _ := strconv.ParseInt(captures[1], 10, 64)
+			file, err := os.OpenFile(temporary, os.O_CREATE|os.O_RDWR, 0o644)
+			if err != nil {
+				response.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if info, err := file.Stat(); err != nil || info.Size() != size {
+				file.Close()
+				response.WriteHeader(http.StatusConflict)
+				return
+			}
+			serverULock.Lock()
+			ranges := serverRangesLoad(received, size)
+			serverULock.Unlock()
+			if size != 0 && (len(ranges) != 1 || ranges[0][0] != 0 || ranges[0][1] != size-1) {
+				file.Close()
+				response.WriteHeader(http.StatusConflict)
+				return
+			}
+			if digests := transfer.ParseDigests(request.Header.Values("Repr-Digest")...); len(digests) != 0 {
+				linear, tree, err := transfer.DigestFile(temporary)
+				if err != nil {
+					file.Close()
+					response.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if (digests[transfer.DigestLinear] != nil && !bytes.Equal(digests[transfer.DigestLinear], linear)) || (digests[transfer.DigestTree] != nil && !bytes.Equal(digests[transfer.DigestTree], tree)) {
+					file.Close()
+					response.WriteHeader(http.StatusUnprocessableEntity)
+					return
+				}
+			}
+			file.Sync()
+			file.Close()
+			if os.Rename(temporary, path) != nil {
+				response.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			os.Remove(received)
+			response.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		if request.Header.Get("Content-Range") == "" {
+			serverStore(response, request, path)
+			return
+		}
+
+		captures := rcache.Get(`^bytes (\d+)-(\d+)/(\d+)$`).FindStringSubmatch(request.Header.Get("Content-Range"))
+		if captures == nil {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		start, _ := strconv.ParseInt(captures[1], 10, 64)
+		end, _ := strconv.ParseInt(captures[2], 10, 64)
+		size, _ := strconv.ParseInt(captures[3], 10, 64)
+		if start > end || end >= size || (request.ContentLength >= 0 && request.ContentLength != end-start+1) {
+			response.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		file, err := os.OpenFile(temporary, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err != nil || info.Size() != size {
+			if file.Truncate(size) != nil {
+				response.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		controller, data, offset := http.NewResponseController(response), make([]byte, 64<<10), start
+		for offset <= end {
+			if controller.SetReadDeadline(time.Now().Add(time.Duration(Timeout)*time.Second)) != nil {
+				response.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			read, err := request.Body.Read(data[:min(int64(len(data)), end-offset+1)])
+			if read > 0 {
+				if _, err := file.WriteAt(data[:read], offset); err != nil {
+					response.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				atomic.AddInt64(&serverReceived, int64(read))
+				offset += int64(read)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if offset <= end {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if file.Sync() != nil || serverRangesAdd(received, size, start, end) != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func serverHandler(root string, writable bool) http.Handler {
+	if root == "" {
+		return serverSimulate()
+	}
+	handler := http.FileServer(http.Dir(root))
+	handler = serverLister(root, handler)
+	if Digest {
+		handler = serverDigester(root, handler)
+	}
+	if writable {
+		handler = serverReceiver(root, handler)
+	}
+	return handler
+}
+
 func base(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Set("Server", PROGNAME+"/"+PROGVER)
 		response.Header().Set("Access-Control-Allow-Origin", "*")
-		response.Header().Set("Access-Control-Allow-Methods", "OPTIONS, HEAD, GET")
-		response.Header().Set("Access-Control-Allow-Headers", "Range")
+		if Writable || Users != "" {
+			response.Header().Set("Access-Control-Allow-Methods", "OPTIONS, HEAD, GET, PUT, POST")
+			response.Header().Set("Access-Control-Allow-Headers", "Range, Content-Range, Repr-Digest")
+
+		} else {
+			response.Header().Set("Access-Control-Allow-Methods", "OPTIONS, HEAD, GET")
+			response.Header().Set("Access-Control-Allow-Headers", "Range")
+		}
 		response.Header().Set("Access-Control-Max-Age", "86400")
+		start, srange, user := time.Now(), "-", ""
+		if captures := rcache.Get(`^bytes=(\d+)-(\d*)$`).FindStringSubmatch(request.Header.Get("Range")); captures != nil {
+			srange = captures[1] + "-" + captures[2]
+		}
+		reject := func(status int) {
+			metricsReject(request.Method, user, status)
+			accessLog(request, user, start, srange, status, 0, time.Since(start))
+			response.WriteHeader(status)
+		}
 		if request.Method == http.MethodOptions {
+			reject(http.StatusOK)
 			return
 		}
-		if request.Method != http.MethodHead && request.Method != http.MethodGet {
-			response.WriteHeader(http.StatusMethodNotAllowed)
+		upload := request.Method == http.MethodPut || request.Method == http.MethodPost
+		if request.Method != http.MethodHead && request.Method != http.MethodGet && (!upload || (!Writable && Users == "")) {
+			reject(http.StatusMethodNotAllowed)
 			return
 		}
-		if Password != "" {
-			_, received, _ := request.BasicAuth()
-			if match, _ := auth.Password(received, []string{Password}, false); !match {
-				response.Header().Set("WWW-Authenticate", `Basic realm="`+PROGNAME+`"`)
-				response.WriteHeader(http.StatusUnauthorized)
+		target, writable := handler, Writable
+		if identity := serverIdentity(request); identity != "" {
+			user = identity
+			if account := usersLookup(identity); account != nil {
+				target, writable = account.handler, account.writable
+
+			} else if Users != "" {
+				reject(http.StatusForbidden)
 				return
 			}
+
+		} else if Password != "" || Secret != "" || Users != "" {
+			if signed, valid := serverSigned(request); signed {
+				if !valid || upload {
+					reject(http.StatusForbidden)
+					return
+				}
+
+			} else {
+				login, received, _ := request.BasicAuth()
+				if account := usersAuthenticate(login, received); account != nil {
+					user, target, writable = login, account.handler, account.writable
+
+				} else if match, _ := auth.Password(received, []string{Password}, false); Password != "" && match {
+					user = login
+
+				} else {
+					response.Header().Set("WWW-Authenticate", `Basic realm="`+PROGNAME+`"`)
+					reject(http.StatusUnauthorized)
+					return
+				}
+			}
 		}
-		if request.URL.Path == "/" || strings.HasPrefix(request.URL.Path, "/.") || strings.Contains(request.URL.Path[1:], "/") {
-			response.WriteHeader(http.StatusNotFound)
+		if upload && !writable {
+			reject(http.StatusForbidden)
+			return
+		}
+		if strings.Contains(request.URL.Path, "/.") || (!Recursive && strings.Contains(request.URL.Path[1:], "/")) {
+			reject(http.StatusNotFound)
 			return
 		}
 
 		atomic.AddInt64(&serverInflight, 1)
-		id, start, writer, srange := atomic.AddInt64(&serverId, 1), time.Now(), serverWriter{rw: response, status: 200}, "-"
-		if captures := rcache.Get(`^bytes=(\d+)-(\d*)$`).FindStringSubmatch(request.Header.Get("Range")); captures != nil {
-			srange = captures[1] + "-" + captures[2]
+		id, writer := atomic.AddInt64(&serverId, 1), serverWriter{rw: response, context: request.Context(), status: 200}
+		if request.Method == http.MethodGet {
+			if serverEgress.Rate() > 0 {
+				writer.limiters = append(writer.limiters, serverEgress)
+			}
+			if serverClient > 0 {
+				key := request.RemoteAddr
+				if host, _, err := net.SplitHostPort(key); err == nil {
+					key = host
+				}
+				if user != "" {
+					key = "user:" + user
+				}
+				writer.limiters = append(writer.limiters, serverAcquire(key))
+				defer serverRelease(key)
+			}
 		}
 		if Dump {
-			serverMessages <- strings.Join([]string{
+			serverMessage(strings.Join([]string{
 				"S",
 				ustr.Int(int(id%10000), 4, 1),
 				start.Format("15:04:05.000"),
@@ -156,10 +814,12 @@ func base(handler http.Handler) http.Handler {
 				request.Method,
 				request.URL.Path,
 				srange,
-			}, "|")
+			}, "|"))
 		}
-		handler.ServeHTTP(&writer, request)
+		target.ServeHTTP(&writer, request)
 		elapsed := time.Since(start)
+		metricsRecord(request.Method, user, request.URL.Path, writer.status, writer.sent, elapsed, writer.throttled)
+		accessLog(request, user, start, srange, writer.status, writer.sent, elapsed)
 		switch {
 		case elapsed >= time.Second:
 			elapsed = elapsed.Truncate(10 * time.Millisecond)
@@ -175,7 +835,7 @@ func base(handler http.Handler) http.Handler {
 			if captures := rcache.Get(`^bytes (\d+-\d+/\d+)$`).FindStringSubmatch(writer.Header().Get("Content-Range")); captures != nil {
 				rrange = captures[1]
 			}
-			serverMessages <- strings.Join([]string{
+			serverMessage(strings.Join([]string{
 				"E",
 				ustr.Int(int(id%10000), 4, 1),
 				time.Now().Format("15:04:05.000"),
@@ -188,15 +848,150 @@ func base(handler http.Handler) http.Handler {
 				rrange,
 				elapsed.String(),
 				utilBandwidth((float64(writer.sent) * 8) / (float64(elapsed) / float64(time.Second))),
-			}, "|")
+			}, "|"))
+			if writer.throttled != 0 {
+				serverMessage(strings.Join([]string{
+					"T",
+					ustr.Int(int(id%10000), 4, 1),
+					time.Now().Format("15:04:05.000"),
+					request.RemoteAddr,
+					request.Method,
+					request.URL.Path,
+					writer.throttled.Truncate(time.Millisecond).String(),
+				}, "|"))
+			}
 		}
 		atomic.AddInt64(&serverInflight, -1)
 	})
 }
 
+func serverInternal(path string) (public, private []byte, err error) {
+	if path != "" {
+		if content, err := os.ReadFile(path); err == nil {
+			for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+				switch block.Type {
+				case "CERTIFICATE":
+					public = pem.EncodeToMemory(block)
+
+				case "EC PRIVATE KEY":
+					private = pem.EncodeToMemory(block)
+				}
+			}
+			if _, err := tls.X509KeyPair(public, private); err != nil {
+				return nil, nil, errors.New("invalid internal certificate " + path)
+			}
+
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+
+	if public == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		private = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		template := x509.Certificate{
+			Subject:     pkix.Name{Organization: []string{PROGNAME}, CommonName: PROGNAME},
+			NotBefore:   time.Now(),
+			NotAfter:    time.Now().Add(10 * 365 * 24 * time.Hour),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			DNSNames:    []string{PROGNAME},
+		}
+		if der, err = x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key); err != nil {
+			return nil, nil, err
+		}
+		public = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if path != "" {
+			if err := transfer.WriteFile(path, append(append([]byte{}, public...), private...), 0o600); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if block, _ := pem.Decode(public); block != nil {
+		if parsed, err := x509.ParseCertificate(block.Bytes); err == nil {
+			spki, _ := x509.MarshalPKIXPublicKey(parsed.PublicKey)
+			os.Stderr.WriteString("\rinternal certificate fingerprint " + utilFingerprint(block.Bytes) + " (public key " + utilFingerprint(spki) + ")     \n")
+		}
+	}
+	return public, private, nil
+}
+
+func serverCertificates() (certificate *dynacert.DYNACERT, err error) {
+	if len(Certificate) == 0 {
+		return nil, nil
+	}
+	certificate = &dynacert.DYNACERT{}
+	for _, value := range Certificate {
+		match := "*"
+		if name, pair, found := strings.Cut(value, "="); found {
+			if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+				return nil, errors.New("invalid certificate hostname in " + value)
+			}
+			match = "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(name), `\*`, `[^.]+`) + "$"
+			value = pair
+		}
+		parts := strings.Split(value, ",")
+		if parts[0] == "internal" {
+			path := ""
+			if len(parts) > 1 {
+				path = strings.TrimSpace(parts[1])
+			}
+			if len(parts) > 2 {
+				return nil, errors.New("invalid certificate " + value)
+			}
+			public, private, err := serverInternal(path)
+			if err != nil {
+				return nil, err
+			}
+			certificate.Inline(match, public, private)
+			continue
+		}
+		if len(parts) != 2 {
+			return nil, errors.New("invalid certificate " + value)
+		}
+		parts[0], parts[1] = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, err := tls.LoadX509KeyPair(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+		certificate.Add(match, parts[0], parts[1])
+	}
+	return certificate, nil
+}
+
 func Server() {
+	if Egress != "" {
+		parts := strings.Split(Egress, ",")
+		limit, err := utilParseBandwidth(parts[0])
+		if err == nil && len(parts) > 1 {
+			serverClient, err = utilParseBandwidth(parts[1])
+		}
+		if err != nil || len(parts) > 2 {
+			os.Stderr.WriteString("invalid egress limit " + Egress + " - aborting\n")
+			os.Exit(1)
+		}
+		serverEgress.Set(limit)
+	}
+	if Metrics != "" {
+		go metricsServe()
+	}
+	if Accesslog != "" {
+		accessRun()
+		defer accessClose()
+	}
+	if Digest {
+		go serverDigestPrune()
+	}
+
 	go func() {
-		previous := int64(0)
+		previous, rprevious := int64(0), int64(0)
 		for {
 			start := time.Now()
 			select {
@@ -205,63 +1000,127 @@ func Server() {
 
 			case <-time.After(time.Second):
 			}
-			current := atomic.LoadInt64(&serverSent)
+			current, rcurrent := atomic.LoadInt64(&serverSent), atomic.LoadInt64(&serverReceived)
 			if previous == 0 {
 				previous = current
 			}
+			if rprevious == 0 {
+				rprevious = rcurrent
+			}
 			if elapsed := time.Since(start); elapsed >= 100*time.Millisecond && Verbose {
-				os.Stderr.WriteString("\r" + strconv.FormatInt(atomic.LoadInt64(&serverInflight), 10) + " | " +
-					utilBandwidth((float64(current-previous)*8)/(float64(elapsed)/float64(time.Second))) + "     ")
-				previous = current
+				line := "\r" + strconv.FormatInt(atomic.LoadInt64(&serverInflight), 10) + " | " +
+					utilBandwidth((float64(current-previous)*8)/(float64(elapsed)/float64(time.Second)))
+				if limit := serverEgress.Rate(); limit > 0 || serverClient > 0 {
+					caps := []string{}
+					if limit > 0 {
+						caps = append(caps, utilBandwidth(limit))
+					}
+					if serverClient > 0 {
+						caps = append(caps, utilBandwidth(serverClient)+" per client")
+					}
+					line += " (max " + strings.Join(caps, ", ") + ")"
+				}
+				if Writable || Users != "" {
+					line += " | " + utilBandwidth((float64(rcurrent-rprevious)*8)/(float64(elapsed)/float64(time.Second)))
+				}
+				if dropped := atomic.LoadInt64(&serverDropped) + atomic.LoadInt64(&accessDropped); dropped != 0 {
+					line += " | " + strconv.FormatInt(dropped, 10) + " dropped"
+				}
+				os.Stderr.WriteString(line + "     ")
+				previous, rprevious = current, rcurrent
 			}
 		}
 	}()
 
-	mux, handler := http.NewServeMux(), serverSimulate()
+	root := ""
 	if Flagset.NArg() > 0 {
-		handler = http.FileServer(http.Dir(Flagset.Args()[0]))
+		root = Flagset.Args()[0]
+
+	} else {
+		Writable = false
 	}
-	mux.Handle("/", base(handler))
+	if Users != "" {
+		usersRun()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", base(serverHandler(root, Writable)))
 
 	server := &http.Server{
-		Handler:     mux,
-		ErrorLog:    log.New(io.Discard, "", 0),
-		IdleTimeout: time.Duration(Timeout) * time.Second * 2,
-		ReadTimeout: time.Duration(Timeout) * time.Second,
+		Handler:           mux,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		IdleTimeout:       time.Duration(Timeout) * time.Second * 2,
+		ReadHeaderTimeout: time.Duration(Timeout) * time.Second,
+	}
+	if !Writable && Users == "" {
+		server.ReadTimeout = time.Duration(Timeout) * time.Second
+	}
+	authorities := (*x509.CertPool)(nil)
+	if ClientCA != "" {
+		content, err := os.ReadFile(ClientCA)
+		if err != nil || len(Certificate) == 0 {
+			os.Stderr.WriteString("invalid client CA bundle " + ClientCA + " (or no server certificate) - aborting\n")
+			os.Exit(1)
+		}
+		if authorities = x509.NewCertPool(); !authorities.AppendCertsFromPEM(content) {
+			os.Stderr.WriteString("no certificate found in client CA bundle " + ClientCA + " - aborting\n")
+			os.Exit(1)
+		}
 	}
-	for {
-		if listener, err := l.NewTCPListener("tcp", Listen, &l.TCPOptions{ReusePort: true}); err == nil {
-			if Certificate != "" {
-				certificate := &dynacert.DYNACERT{}
-				if Certificate == "internal" {
-					if key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err == nil {
-						if der, err := x509.MarshalECPrivateKey(key); err == nil {
-							pkey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
-							template := x509.Certificate{
-								Subject:     pkix.Name{Organization: []string{PROGNAME}, CommonName: PROGNAME},
-								NotBefore:   time.Now(),
-								NotAfter:    time.Now().Add(10 * 365 * 24 * time.Hour),
-								KeyUsage:    x509.KeyUsageDigitalSignature,
-								ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-								DNSNames:    []string{PROGNAME},
-							}
-							if der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key); err == nil {
-								certificate.Inline("*", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pkey)
-							}
-						}
-					}
 
-				} else if parts := strings.Split(Certificate, ","); len(parts) >= 2 {
-					certificate.Add("*", parts[0], parts[1])
+	certificate, err := serverCertificates()
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + " - aborting\n")
+		os.Exit(1)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+		for value := range signals {
+			if value == syscall.SIGUSR2 {
+				if err := serverHandoff(); err != nil {
+					os.Stderr.WriteString("\r" + err.Error() + " - ignoring     \n")
+					continue
 				}
+			}
+			break
+		}
+		if Verbose {
+			os.Stderr.WriteString("\rshutting down (" + strconv.FormatInt(atomic.LoadInt64(&serverInflight), 10) + " in-flight requests)     \n")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Drain)*time.Second)
+		if server.Shutdown(ctx) != nil {
+			server.Close()
+		}
+		cancel()
+		close(stopped)
+	}()
+
+	for {
+		if listener, err := l.NewTCPListener("tcp", Listen, &l.TCPOptions{ReusePort: true}); err == nil {
+			serverReady()
+			if certificate != nil {
 				server.TLSConfig = certificate.TLSConfig()
+				if authorities != nil {
+					server.TLSConfig.ClientCAs, server.TLSConfig.ClientAuth = authorities, tls.RequireAndVerifyClientCert
+				}
 				server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
-				server.ServeTLS(listener, "", "")
+				err = server.ServeTLS(listener, "", "")
 
 			} else {
-				server.Serve(listener)
+				err = server.Serve(listener)
 			}
+			if errors.Is(err, http.ErrServerClosed) {
+				break
+			}
+		}
+		select {
+		case <-stopped:
+			return
+
+		case <-time.After(time.Second):
 		}
-		time.Sleep(time.Second)
 	}
+	<-stopped
 }
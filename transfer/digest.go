@@ -0,0 +1,229 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pyke369/golang-support/rcache"
+)
+
+// Supported digest algorithms (as named in Repr-Digest headers); tree digests hash the
+// concatenated SHA-256 sums of all 4MiB blocks, so they may be computed out of order.
+const (
+	DigestLinear = "sha-256"
+	DigestTree   = "sha-256-tree"
+	digestBlock  = int64(4 << 20)
+)
+
+type digestLeaf struct {
+	hash hash.Hash
+	next int64
+	sum  []byte
+}
+
+// Digest incrementally computes a document digest from (possibly unordered) writes.
+type Digest struct {
+	algorithm string
+	lock      sync.Mutex
+	linear    hash.Hash
+	next      int64
+	leaves    map[int64]*digestLeaf
+}
+
+// NewDigest returns a Digest for the provided algorithm (DigestLinear if unknown).
+func NewDigest(algorithm string) *Digest {
+	if algorithm == DigestTree {
+		return &Digest{algorithm: algorithm, leaves: map[int64]*digestLeaf{}}
+	}
+	return &Digest{algorithm: DigestLinear, linear: sha256.New()}
+}
+
+// Write adds data found at offset in the document; linear digests ignore out of order data
+// (which is read back from the file by Sum).
+func (d *Digest) Write(data []byte, offset int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.linear != nil {
+		if offset == d.next {
+			d.linear.Write(data)
+			d.next += int64(len(data))
+		}
+		return
+	}
+	for len(data) > 0 {
+		index, position := offset/digestBlock, offset%digestBlock
+		length := min(int64(len(data)), digestBlock-position)
+		leaf := d.leaves[index]
+		if leaf == nil {
+			leaf = &digestLeaf{hash: sha256.New()}
+			d.leaves[index] = leaf
+		}
+		if leaf.hash != nil && position == leaf.next {
+			leaf.hash.Write(data[:length])
+			leaf.next += length
+			if leaf.next == digestBlock {
+				leaf.sum, leaf.hash = leaf.hash.Sum(nil), nil
+			}
+
+		} else if leaf.sum == nil {
+			leaf.hash, leaf.next = nil, -1
+		}
+		data, offset = data[length:], offset+length
+	}
+}
+
+func (d *Digest) follow(file *os.File, frontier int64) (err error) {
+	data := make([]byte, 1<<20)
+	for {
+		d.lock.Lock()
+		next := d.next
+		d.lock.Unlock()
+		if d.linear == nil || next >= frontier {
+			return nil
+		}
+		read, err := file.ReadAt(data[:min(int64(len(data)), frontier-next)], next)
+		if read == 0 && err != nil {
+			return err
+		}
+		d.lock.Lock()
+		if d.next == next {
+			d.linear.Write(data[:read])
+			d.next += int64(read)
+		}
+		d.lock.Unlock()
+	}
+}
+
+// Sum returns the digest of the first size bytes of the document, reading missing data
+// from file if needed (or failing if file is nil).
+func (d *Digest) Sum(file *os.File, size int64) (sum []byte, err error) {
+	if d.linear != nil {
+		d.lock.Lock()
+		next := d.next
+		d.lock.Unlock()
+		if next < size {
+			if file == nil {
+				return nil, errors.New("incomplete digest")
+			}
+			if err := d.follow(file, size); err != nil {
+				return nil, err
+			}
+		}
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.linear.Sum(nil), nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	root := sha256.New()
+	for index := int64(0); index*digestBlock < size; index++ {
+		length, leaf := min(digestBlock, size-index*digestBlock), d.leaves[index]
+		if leaf == nil || (leaf.sum == nil && leaf.next != length) {
+			if file == nil {
+				return nil, errors.New("incomplete digest")
+			}
+			data := make([]byte, length)
+			if _, err := file.ReadAt(data, index*digestBlock); err != nil && err != io.EOF {
+				return nil, err
+			}
+			value := sha256.Sum256(data)
+			leaf = &digestLeaf{sum: value[:]}
+		}
+		if leaf.sum == nil {
+			leaf.sum = leaf.hash.Sum(nil)
+		}
+		root.Write(leaf.sum)
+	}
+	return root.Sum(nil), nil
+}
+
+func (d *Digest) blocks() (blocks map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	blocks = map[string]string{}
+	for index, leaf := range d.leaves {
+		if leaf.sum != nil {
+			blocks[strconv.FormatInt(index, 10)] = hex.EncodeToString(leaf.sum)
+		}
+	}
+	return
+}
+
+func (d *Digest) restore(blocks map[string]string) {
+	if d.linear != nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, value := range blocks {
+		index, err1 := strconv.ParseInt(key, 10, 64)
+		sum, err2 := hex.DecodeString(value)
+		if err1 == nil && err2 == nil && index >= 0 && len(sum) == sha256.Size {
+			d.leaves[index] = &digestLeaf{next: digestBlock, sum: sum}
+		}
+	}
+}
+
+// DigestFile returns both the linear and tree digests of a local file.
+func DigestFile(path string) (linear, tree []byte, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	dlinear, dtree, offset, data := NewDigest(DigestLinear), NewDigest(DigestTree), int64(0), make([]byte, 1<<20)
+	for {
+		read, err := file.Read(data)
+		if read > 0 {
+			dlinear.Write(data[:read], offset)
+			dtree.Write(data[:read], offset)
+			offset += int64(read)
+		}
+		if err != nil {
+			if err != io.EOF {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+	linear, _ = dlinear.Sum(nil, offset)
+	tree, _ = dtree.Sum(nil, offset)
+	return linear, tree, nil
+}
+
+// ParseDigests extracts SHA-256 based digests from Repr-Digest (or Digest) header values,
+// indexed by lowercase algorithm name.
+func ParseDigests(values ...string) (digests map[string][]byte) {
+	digests = map[string][]byte{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if captures := rcache.Get(`^\s*([a-zA-Z0-9\-]+)\s*=\s*:?([A-Za-z0-9+/=]+):?\s*$`).FindStringSubmatch(item); captures != nil {
+				if decoded, err := base64.StdEncoding.DecodeString(captures[2]); err == nil && len(decoded) == sha256.Size {
+					if algorithm := strings.ToLower(captures[1]); digests[algorithm] == nil {
+						digests[algorithm] = decoded
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+func digestSidecar(content []byte) []byte {
+	if fields := strings.Fields(string(content)); len(fields) > 0 {
+		if decoded, err := hex.DecodeString(fields[0]); err == nil && len(decoded) == sha256.Size {
+			return decoded
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package transfer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by any number of transfers (or server responses); the
+// zero value (like a nil Limiter) does not limit anything.
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Set changes the limiter bandwidth (in bits per second, 0 for unlimited).
+func (l *Limiter) Set(bandwidth float64) {
+	l.lock.Lock()
+	l.rate, l.tokens, l.last = max(0, bandwidth), 0, time.Time{}
+	l.lock.Unlock()
+}
+
+// Rate returns the limiter bandwidth (in bits per second, 0 for unlimited).
+func (l *Limiter) Rate() (bandwidth float64) {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	bandwidth = l.rate
+	l.lock.Unlock()
+	return
+}
+
+// Wait blocks until size bytes may be transfered, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, size int) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	now, rate := time.Now(), l.rate/8
+	burst := max(rate/10, 64<<10)
+	if l.last.IsZero() {
+		l.tokens = burst
+
+	} else {
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+	l.tokens -= float64(size)
+	delay := time.Duration(0)
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,1297 @@
+// Package transfer moves HTTP(S) documents over multiple concurrent range requests (or
+// local files over multiple concurrent partial uploads); it is the engine of the mfetch
+// command-line client.
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyke369/golang-support/bslab"
+	"github.com/pyke369/golang-support/rcache"
+)
+
+// Version is the mfetch version, advertised in the default User-Agent header.
+const Version = "1.3.0"
+
+// Failure classes reported in Error.Code (and used as mfetch exit codes).
+const (
+	CodeSource      = 1 // initial source request, or local source file in upload mode
+	CodeTarget      = 2 // local target file, or remote target request setup
+	CodeChunk       = 3 // chunk request, once retries are exhausted
+	CodeUpload      = 4 // remote target, or ordered output writer
+	CodeDigest      = 5 // digest verification
+	CodeChanged     = 7 // source changed during transfer
+	CodeInterrupted = 8 // Run context cancelled
+)
+
+var (
+	// ErrChanged is reported when the source document changes during a transfer.
+	ErrChanged = errors.New("source changed during transfer")
+
+	// ErrInterrupted is reported when the Run context is cancelled.
+	ErrInterrupted = errors.New("transfer interrupted")
+)
+
+// Config describes a transfer; only Source is mandatory.
+type Config struct {
+	Source        string        // source URL (or local file path if Target is an URL)
+	Target        string        // local file path or target URL (see Writer if empty)
+	Writer        io.Writer     // ordered output if Target is empty (data is discarded if both are empty)
+	Mirrors       []string      // alternate source URLs for the same document
+	Headers       http.Header   // additional source requests headers ("Host" overrides the request host)
+	TargetHeaders http.Header   // additional target requests headers
+	Post          bool          // use POST instead of PUT for target requests
+	Concurrency   int           // maximum concurrent requests (default 6, or 32 if Adaptive, max 32)
+	Adaptive      bool          // adjust the number of concurrent requests to the measured bandwidth
+	Memory        int           // maximum memory used for ordered output (default 384MiB)
+	Retries       int           // maximum retries per chunk (default 5, negative for none, max 100)
+	Timeout       time.Duration // requests timeout if Client is nil (default 10s)
+	Verify        string        // verify the document digest (DigestLinear or DigestTree, default none)
+	Resume        bool          // resume interrupted transfers from (and into) a state file next to the local file
+	UserAgent     string        // requests User-Agent header (default "mfetch/" + Version)
+	Client        *http.Client  // HTTP client (default built from Timeout)
+	Limiter       *Limiter      // bandwidth limiter, possibly shared with other transfers (default none)
+	Slots         chan struct{} // requests slots, possibly shared with other transfers (default none)
+	Dump          io.Writer     // requests, responses and retries dump output (default none)
+	Progress      func(Status)  // progress callback, possibly called from several goroutines at once
+}
+
+// Status is passed to the Config.Progress callback, with one of the following events:
+//   - "start", "progress" (every second) and "end" (once all data has been moved, with Err set on failure)
+//   - "retry" (with Chunk, Attempt, Offset, Delay and Err set) before a chunk request is retried
+//   - "ignore" and "drop" (with Mirror and Err set) when a mirror is rejected before or during the transfer
+//   - "resume" (with Err set if the state was refused) when a resume state file is found
+//   - "verify" (with Algorithm and Digest set) once the document digest has been verified
+type Status struct {
+	Event       string
+	Concurrency int
+	Size        int64 // -1 if unknown
+	Received    int64
+	Retries     int64
+	Elapsed     time.Duration
+	Chunk       int
+	Attempt     int
+	Offset      int64
+	Delay       time.Duration
+	Mirror      string
+	Algorithm   string
+	Digest      []byte
+	Err         error
+}
+
+// Error is returned by Run on failure.
+type Error struct {
+	Code int // one of the Code* constants
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Transfer moves one document; it may be run only once.
+type Transfer struct {
+	config       Config
+	client       *http.Client
+	sources      []*transferSource
+	etag         string
+	modified     int64
+	concurrency  int
+	level        int
+	size         int64
+	received     int64
+	retries      int64
+	start        time.Time
+	segments     []*transferSegment
+	split        bool
+	steal        bool
+	resume       string
+	resumeTarget string
+	saved        []byte
+	blocks       map[string]string
+	digest       *Digest
+	digests      map[string][]byte
+	parent       context.Context
+	context      context.Context
+	cancel       context.CancelFunc
+	code         int
+	err          error
+	lock         sync.Mutex
+	slock        sync.Mutex
+	rlock        sync.Mutex
+}
+
+type transferSegment struct {
+	start  int64
+	offset int64
+	end    int64
+	active bool
+}
+
+type transferSource struct {
+	url      string
+	active   int
+	failures int
+	received int64
+	busy     time.Duration
+	dead     bool
+}
+
+type transferChunk struct {
+	id       int
+	mirror   *transferSource
+	retries  int
+	segment  *transferSegment
+	size     int64
+	start    int64
+	offset   int64
+	end      int64
+	request  []byte
+	response []byte
+	status   int
+	modified int64
+	etag     string
+	file     *os.File
+	source   *os.File
+	writer   io.Writer
+	data     []byte
+}
+
+// ResumePath returns the resume state file path used for a local target file.
+func ResumePath(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".resume")
+}
+
+// New returns a Transfer for the provided configuration, applying the mfetch command-line
+// client defaults to unset fields.
+func New(config Config) *Transfer {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 6
+		if config.Adaptive {
+			config.Concurrency = 32
+		}
+	}
+	config.Concurrency = min(32, config.Concurrency)
+	if config.Memory <= 0 {
+		config.Memory = 6 * 64 << 20
+	}
+	config.Memory = (max(config.Concurrency*8<<20, config.Memory) / config.Concurrency) * config.Concurrency
+	if config.Retries == 0 {
+		config.Retries = 5
+	}
+	config.Retries = min(100, max(0, config.Retries))
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = "mfetch/" + Version
+	}
+	t := &Transfer{config: config, client: config.Client, concurrency: config.Concurrency, size: -1, split: true, steal: true, digests: map[string][]byte{}}
+	if t.client == nil {
+		t.client = &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: config.Timeout}).DialContext,
+			TLSHandshakeTimeout:   config.Timeout,
+			ResponseHeaderTimeout: config.Timeout,
+			ReadBufferSize:        8 << 20,
+			WriteBufferSize:       1 << 20,
+			MaxIdleConnsPerHost:   32,
+		}}
+	}
+	t.sources = []*transferSource{{url: config.Source}}
+	return t
+}
+
+// Status returns a snapshot of the transfer progress; it may be called at any time.
+func (t *Transfer) Status() (status Status) {
+	t.lock.Lock()
+	status.Concurrency, status.Size = t.concurrency, t.size
+	if t.level > 0 {
+		status.Concurrency = t.level
+	}
+	if !t.start.IsZero() {
+		status.Elapsed = time.Since(t.start)
+	}
+	t.lock.Unlock()
+	status.Received, status.Retries = atomic.LoadInt64(&t.received), atomic.LoadInt64(&t.retries)
+	return
+}
+
+func (t *Transfer) notify(status Status) {
+	if t.config.Progress == nil {
+		return
+	}
+	current := t.Status()
+	status.Concurrency, status.Size, status.Received, status.Retries, status.Elapsed = current.Concurrency, current.Size, current.Received, current.Retries, current.Elapsed
+	if status.Event == "end" && status.Err == nil && status.Size < 0 {
+		status.Size = status.Received
+	}
+	t.config.Progress(status)
+}
+
+func (t *Transfer) dump(parts ...[]byte) {
+	if t.config.Dump != nil {
+		t.config.Dump.Write(bytes.Join(parts, nil))
+	}
+}
+
+// SetHeaders adds headers to request, a "Host" header overriding the request host.
+func SetHeaders(request *http.Request, headers http.Header) {
+	for name, values := range headers {
+		if len(values) == 0 {
+			continue
+		}
+		if strings.EqualFold(name, "host") {
+			request.Host = values[len(values)-1]
+
+		} else {
+			request.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+}
+
+func (t *Transfer) fail(code int, err error) error {
+	if errors.Is(err, ErrChanged) {
+		code = CodeChanged
+
+	} else if t.parent.Err() != nil {
+		code, err = CodeInterrupted, ErrInterrupted
+	}
+	t.lock.Lock()
+	if t.err == nil {
+		t.code, t.err = code, err
+	}
+	err = t.err
+	t.lock.Unlock()
+	t.cancel()
+	return err
+}
+
+func (t *Transfer) failure() (err error) {
+	t.lock.Lock()
+	err = t.err
+	t.lock.Unlock()
+	return
+}
+
+func (t *Transfer) segmentsLoad(ranges [][3]int64) {
+	size := max(digestBlock, (min(64<<20, t.size/int64(max(1, t.concurrency)*4))/digestBlock)*digestBlock)
+	t.slock.Lock()
+	t.segments = t.segments[:0]
+	for _, value := range ranges {
+		if !t.split || value[1] != value[0] {
+			t.segments = append(t.segments, &transferSegment{start: value[0], offset: value[1], end: value[2]})
+			continue
+		}
+		for start := value[0]; start <= value[2]; start += size {
+			t.segments = append(t.segments, &transferSegment{start: start, offset: start, end: min(start+size, value[2]+1) - 1})
+		}
+	}
+	t.slock.Unlock()
+}
+
+func (t *Transfer) segmentsState() (ranges [][3]int64) {
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	for _, segment := range t.segments {
+		if length := len(ranges); length > 0 {
+			if last := &ranges[length-1]; (last[1] == last[2]+1 && segment.offset == segment.end+1) || (last[1] == last[0] && segment.offset == segment.start) {
+				if last[1] != last[0] {
+					last[1] = segment.end + 1
+				}
+				last[2] = segment.end
+				continue
+			}
+		}
+		ranges = append(ranges, [3]int64{segment.start, segment.offset, segment.end})
+	}
+	return
+}
+
+func (t *Transfer) frontier() int64 {
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	for _, segment := range t.segments {
+		if segment.offset <= segment.end {
+			return segment.offset
+		}
+	}
+	return t.size
+}
+
+func (t *Transfer) schedule() *transferSegment {
+	if t.context.Err() != nil {
+		return nil
+	}
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	for _, segment := range t.segments {
+		if !segment.active && segment.offset <= segment.end {
+			segment.active = true
+			return segment
+		}
+	}
+	if !t.split || !t.steal {
+		return nil
+	}
+
+	victim := -1
+	for index, segment := range t.segments {
+		if segment.active && segment.end-segment.offset >= 2*digestBlock && (victim < 0 || segment.end-segment.offset > t.segments[victim].end-t.segments[victim].offset) {
+			victim = index
+		}
+	}
+	if victim < 0 {
+		return nil
+	}
+	middle := t.segments[victim].offset + (t.segments[victim].end-t.segments[victim].offset+1)/2
+	middle = ((middle + digestBlock - 1) / digestBlock) * digestBlock
+	segment := &transferSegment{start: middle, offset: middle, end: t.segments[victim].end, active: true}
+	t.segments[victim].end = middle - 1
+	t.segments = append(t.segments[:victim+1], append([]*transferSegment{segment}, t.segments[victim+1:]...)...)
+	return segment
+}
+
+func (t *Transfer) release(segment *transferSegment) {
+	t.slock.Lock()
+	segment.active = false
+	t.slock.Unlock()
+}
+
+func (t *Transfer) pick() (source *transferSource) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	fallback, score := float64(1), float64(0)
+	for _, source := range t.sources {
+		if source.busy > 0 {
+			fallback = max(fallback, float64(source.received)/source.busy.Seconds())
+		}
+	}
+	for _, value := range t.sources {
+		if value.dead {
+			continue
+		}
+		rate := fallback
+		if value.busy > 0 {
+			rate = max(1, float64(value.received)/value.busy.Seconds())
+		}
+		if current := float64(value.active+1) / rate; source == nil || current < score {
+			source, score = value, current
+		}
+	}
+	source.active++
+	return
+}
+
+// must be called with t.lock held, the caller notifies the drop once the lock is released
+func (t *Transfer) drop(source *transferSource) bool {
+	alive := 0
+	for _, value := range t.sources {
+		if !value.dead {
+			alive++
+		}
+	}
+	if source.dead || alive <= 1 {
+		return false
+	}
+	source.dead = true
+	return true
+}
+
+func (t *Transfer) account(chunk *transferChunk, received int64, elapsed time.Duration, err error) (dead bool) {
+	dropped := false
+	t.lock.Lock()
+	source := chunk.mirror
+	source.active--
+	source.received += max(0, received)
+	source.busy += elapsed
+	if err != nil && t.context.Err() == nil {
+		if source.failures++; source.failures >= 2 || errors.Is(err, ErrChanged) || (chunk.status/100 == 4 && chunk.status != http.StatusRequestTimeout && chunk.status != http.StatusTooManyRequests) {
+			dropped = t.drop(source)
+		}
+
+	} else if err == nil {
+		source.failures = 0
+	}
+	dead = source.dead
+	t.lock.Unlock()
+	if dropped {
+		t.notify(Status{Event: "drop", Mirror: source.url, Err: err})
+	}
+	return
+}
+
+func (t *Transfer) probe(mirror string) (err error) {
+	source := &transferSource{url: mirror}
+	chunk := transferChunk{mirror: source}
+	if err := t.request(&chunk); err != nil {
+		return err
+	}
+	if chunk.status != http.StatusPartialContent || chunk.size != t.size {
+		return errors.New("size mismatch")
+	}
+	if chunk.etag != t.etag {
+		return errors.New("etag mismatch")
+	}
+	if chunk.modified != t.modified {
+		return errors.New("last-modified mismatch")
+	}
+	t.lock.Lock()
+	t.sources = append(t.sources, source)
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *Transfer) concurrent() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.level > 0 {
+		return t.level
+	}
+	return t.concurrency
+}
+
+func (t *Transfer) pending() bool {
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	for _, segment := range t.segments {
+		if segment.offset <= segment.end {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Transfer) adapt(stop chan struct{}) {
+	previous, retries, slowstart, stable := atomic.LoadInt64(&t.received), atomic.LoadInt64(&t.retries), true, 0
+	last := float64(0)
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-time.After(2 * time.Second):
+		}
+		received, current := atomic.LoadInt64(&t.received), atomic.LoadInt64(&t.retries)
+		bandwidth := float64(received-previous) * 8 / 2
+		t.lock.Lock()
+		level := t.level
+		switch {
+		case current != retries:
+			level, slowstart, stable = max(1, level/2), false, 0
+
+		case bandwidth > last*1.1:
+			if slowstart {
+				level *= 2
+
+			} else {
+				level++
+			}
+			stable = 0
+
+		case bandwidth < last*0.9:
+			level, slowstart, stable = max(1, level-1), false, 0
+
+		default:
+			if slowstart, stable = false, stable+1; stable >= 5 {
+				level, stable = level+1, 0
+			}
+		}
+		t.level = min(t.concurrency, level)
+		t.lock.Unlock()
+		previous, retries, last = received, current, bandwidth
+	}
+}
+
+func (t *Transfer) pool(file, source *os.File) {
+	if t.config.Adaptive {
+		t.lock.Lock()
+		t.level = min(2, t.concurrency)
+		t.lock.Unlock()
+		stop := make(chan struct{})
+		defer close(stop)
+		go t.adapt(stop)
+	}
+
+	waiter := sync.WaitGroup{}
+	for worker := 0; worker < t.concurrency; worker++ {
+		waiter.Add(1)
+		go func(worker int) {
+			defer waiter.Done()
+			for {
+				for worker >= t.concurrent() {
+					if t.context.Err() != nil || !t.pending() {
+						return
+					}
+					time.Sleep(250 * time.Millisecond)
+				}
+				segment := t.schedule()
+				if segment == nil {
+					return
+				}
+				chunk := transferChunk{id: worker, start: segment.start, offset: segment.offset, end: segment.end, file: file, source: source, segment: segment}
+				if err := t.fetch(&chunk); err != nil {
+					t.fail(CodeChunk, err)
+				}
+				t.release(segment)
+			}
+		}(worker)
+	}
+	waiter.Wait()
+}
+
+func (t *Transfer) sourceRequest(method, source string) (request *http.Request, err error) {
+	if request, err = http.NewRequestWithContext(t.context, method, source, http.NoBody); err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", t.config.UserAgent)
+	SetHeaders(request, t.config.Headers)
+	return request, nil
+}
+
+func (t *Transfer) request(chunk *transferChunk) (err error) {
+	if chunk.segment != nil {
+		t.slock.Lock()
+		chunk.end = chunk.segment.end
+		t.slock.Unlock()
+		if chunk.offset > chunk.end {
+			return nil
+		}
+	}
+	source := t.config.Source
+	if chunk.mirror != nil {
+		source = chunk.mirror.url
+	}
+	request, err := t.sourceRequest(http.MethodGet, source)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", "bytes="+strconv.FormatInt(chunk.offset, 10)+"-"+strconv.FormatInt(chunk.end, 10))
+	conditional := false
+	if chunk.segment != nil || chunk.data != nil {
+		if t.etag != "" && !strings.HasPrefix(t.etag, "W/") {
+			request.Header.Set("If-Match", t.etag)
+			request.Header.Set("If-Range", t.etag)
+			conditional = true
+
+		} else if t.modified != 0 {
+			request.Header.Set("If-Unmodified-Since", time.Unix(t.modified, 0).UTC().Format(http.TimeFormat))
+			request.Header.Set("If-Range", time.Unix(t.modified, 0).UTC().Format(http.TimeFormat))
+			conditional = true
+		}
+	}
+	if t.config.Dump != nil {
+		chunk.request, _ = httputil.DumpRequest(request, false)
+	}
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	if t.config.Dump != nil {
+		chunk.response, _ = httputil.DumpResponse(response, false)
+	}
+
+	chunk.status = response.StatusCode
+	if chunk.status == http.StatusPreconditionFailed || (conditional && chunk.status == http.StatusOK) {
+		response.Body.Close()
+		return ErrChanged
+	}
+	chunk.etag = strings.TrimSpace(response.Header.Get("Etag"))
+	if t.config.Verify != "" {
+		if digests := ParseDigests(append(response.Header.Values("Repr-Digest"), response.Header.Values("Digest")...)...); len(digests) != 0 {
+			t.lock.Lock()
+			t.digests = digests
+			t.lock.Unlock()
+		}
+	}
+	if modified, err := time.Parse(time.RFC1123, response.Header.Get("Last-Modified")); err == nil {
+		chunk.modified = modified.Unix()
+	}
+	if captures := rcache.Get(`^bytes (\d+)-\d+/(\d+)$`).FindStringSubmatch(response.Header.Get("Content-Range")); captures != nil && chunk.status == http.StatusPartialContent {
+		chunk.offset, _ = strconv.ParseInt(captures[1], 10, 64)
+		chunk.size, _ = strconv.ParseInt(captures[2], 10, 64)
+
+	} else {
+		if chunk.status == http.StatusOK && chunk.offset > 0 {
+			response.Body.Close()
+			return errors.New("source ignored range request")
+		}
+		chunk.offset, chunk.size = 0, response.ContentLength
+	}
+	if chunk.status/100 != 2 {
+		response.Body.Close()
+		return errors.New("source http status " + strconv.Itoa(chunk.status))
+	}
+	if chunk.segment != nil || chunk.data != nil {
+		t.lock.Lock()
+		mirrors := len(t.sources) > 1
+		t.lock.Unlock()
+		if mirrors && (chunk.size != t.size || chunk.etag != t.etag || chunk.modified != t.modified) {
+			response.Body.Close()
+			err := errors.New("source content mismatch")
+			t.lock.Lock()
+			dropped := t.drop(chunk.mirror)
+			t.lock.Unlock()
+			if dropped {
+				t.notify(Status{Event: "drop", Mirror: chunk.mirror.url, Err: errors.New("content mismatch")})
+			}
+			return err
+		}
+	}
+	if chunk.size == 0 || (chunk.size < 0 && chunk.start == 0 && chunk.end == 0) {
+		response.Body.Close()
+		return nil
+	}
+
+	data := make([]byte, 64<<10)
+	for {
+		read, err := response.Body.Read(data)
+		if chunk.segment != nil {
+			t.slock.Lock()
+			chunk.end = chunk.segment.end
+			t.slock.Unlock()
+			if chunk.offset+int64(read) > chunk.end {
+				read, err = int(chunk.end+1-chunk.offset), io.EOF
+			}
+		}
+		if read > 0 {
+			if err := t.config.Limiter.Wait(t.context, read); err != nil {
+				response.Body.Close()
+				return err
+			}
+			atomic.AddInt64(&t.received, int64(read))
+			switch {
+			case chunk.file != nil:
+				if chunk.start < 0 && chunk.end < 0 {
+					_, err = chunk.file.Write(data[:read])
+
+				} else {
+					t.lock.Lock()
+					_, err = chunk.file.WriteAt(data[:read], chunk.offset)
+					t.lock.Unlock()
+				}
+				if err != nil {
+					response.Body.Close()
+					return err
+				}
+
+			case chunk.writer != nil:
+				if _, err = chunk.writer.Write(data[:read]); err != nil {
+					response.Body.Close()
+					return err
+				}
+
+			case chunk.data != nil:
+				copy(chunk.data[chunk.offset-chunk.start:], data[:read])
+			}
+			if t.digest != nil && chunk.data == nil {
+				t.digest.Write(data[:read], chunk.offset)
+			}
+			chunk.offset += int64(read)
+			if chunk.segment != nil {
+				t.slock.Lock()
+				chunk.segment.offset = chunk.offset
+				t.slock.Unlock()
+			}
+		}
+		if err != nil {
+			response.Body.Close()
+			if err != io.EOF {
+				return err
+			}
+			if chunk.size > 0 && chunk.offset != chunk.end+1 {
+				return errors.New("truncated transfer")
+			}
+			return nil
+		}
+	}
+}
+
+func (t *Transfer) fetch(chunk *transferChunk) (err error) {
+	slots := t.config.Slots
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-t.context.Done():
+				return t.context.Err()
+			}
+		}
+		chunk.status, chunk.request, chunk.response = 0, nil, nil
+		if chunk.source != nil {
+			err = t.uploadRequest(chunk)
+
+		} else {
+			chunk.mirror = t.pick()
+			start, offset := time.Now(), chunk.offset
+			err = t.request(chunk)
+			if t.account(chunk, chunk.offset-offset, time.Since(start), err) && err != nil {
+				if slots != nil {
+					<-slots
+				}
+				continue
+			}
+		}
+		if slots != nil {
+			<-slots
+		}
+		if err == nil {
+			return nil
+		}
+		if t.context.Err() != nil || errors.Is(err, ErrChanged) || chunk.start < 0 || chunk.end < 0 || chunk.retries >= t.config.Retries ||
+			(chunk.status/100 == 4 && chunk.status != http.StatusRequestTimeout && chunk.status != http.StatusTooManyRequests) ||
+			(chunk.status == http.StatusOK && chunk.offset > 0) {
+			return err
+		}
+		chunk.retries++
+		atomic.AddInt64(&t.retries, 1)
+		delay := min(30*time.Second, (500*time.Millisecond)<<(chunk.retries-1))
+		if t.config.Dump != nil {
+			t.dump([]byte("\r"), chunk.request, chunk.response, []byte(strings.Join([]string{
+				"R",
+				strconv.Itoa(chunk.id),
+				strconv.Itoa(chunk.retries) + "/" + strconv.Itoa(t.config.Retries),
+				strconv.FormatInt(chunk.offset, 10) + "-" + strconv.FormatInt(chunk.end, 10),
+				delay.String(),
+				err.Error(),
+			}, "|")+"\n"))
+		}
+		t.notify(Status{Event: "retry", Chunk: chunk.id, Attempt: chunk.retries, Offset: chunk.offset, Delay: delay, Err: err})
+		select {
+		case <-time.After(delay):
+		case <-t.context.Done():
+			return err
+		}
+	}
+}
+
+func (t *Transfer) verify(file *os.File) error {
+	if t.digest == nil {
+		return nil
+	}
+	sum, err := t.digest.Sum(file, atomic.LoadInt64(&t.received))
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	expected := t.digests[t.digest.algorithm]
+	t.lock.Unlock()
+	// the source may still be computing its digests (mfetch servers do it in the background), ask again before looking for a sidecar
+probe:
+	for attempt := 1; expected == nil; attempt++ {
+		request, err := t.sourceRequest(http.MethodHead, t.config.Source)
+		if err != nil {
+			break
+		}
+		response, err := t.client.Do(request)
+		if err != nil {
+			break
+		}
+		response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			break
+		}
+		expected = ParseDigests(append(response.Header.Values("Repr-Digest"), response.Header.Values("Digest")...)...)[t.digest.algorithm]
+		if expected != nil || attempt > t.config.Retries || !strings.HasPrefix(response.Header.Get("Server"), "mfetch/") {
+			break
+		}
+		select {
+		case <-time.After(min(30*time.Second, (500*time.Millisecond)<<(attempt-1))):
+		case <-t.context.Done():
+			break probe
+		}
+	}
+	if expected == nil {
+		suffix := ".sha256"
+		if t.digest.algorithm == DigestTree {
+			suffix = ".sha256-tree"
+		}
+		if source, err := url.Parse(t.config.Source); err == nil {
+			source.Path += suffix
+			source.RawPath = ""
+			if request, err := t.sourceRequest(http.MethodGet, source.String()); err == nil {
+				if response, err := t.client.Do(request); err == nil {
+					if response.StatusCode == http.StatusOK {
+						content, _ := io.ReadAll(io.LimitReader(response.Body, 4<<10))
+						expected = digestSidecar(content)
+					}
+					response.Body.Close()
+				}
+			}
+		}
+	}
+	if expected == nil {
+		return errors.New("no source " + t.digest.algorithm + " digest available")
+	}
+	if !bytes.Equal(sum, expected) {
+		return errors.New(t.digest.algorithm + " digest mismatch (expected " + hex.EncodeToString(expected) + ", received " + hex.EncodeToString(sum) + ")")
+	}
+	t.notify(Status{Event: "verify", Algorithm: t.digest.algorithm, Digest: sum})
+	return nil
+}
+
+func (t *Transfer) save() {
+	if t.resume == "" {
+		return
+	}
+	state := map[string]any{"version": 2, "source": t.config.Source, "size": t.size, "segments": t.segmentsState()}
+	if t.resumeTarget != "" {
+		state["target"] = t.resumeTarget
+	}
+	if t.etag != "" {
+		state["etag"] = t.etag
+	}
+	if t.modified != 0 {
+		state["modified"] = t.modified
+	}
+	if t.digest != nil && t.digest.linear == nil {
+		if blocks := t.digest.blocks(); len(blocks) != 0 {
+			state["blocks"] = blocks
+		}
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	t.rlock.Lock()
+	if !bytes.Equal(payload, t.saved) && WriteFile(t.resume, payload, 0o644) == nil {
+		t.saved = payload
+	}
+	t.rlock.Unlock()
+}
+
+func (t *Transfer) restore(payload []byte, legacy bool) (ranges [][3]int64, err error) {
+	var state struct {
+		Version  int               `json:"version"`
+		Source   string            `json:"source"`
+		Target   string            `json:"target"`
+		Size     int64             `json:"size"`
+		Etag     string            `json:"etag"`
+		Modified int64             `json:"modified"`
+		Segments [][3]int64        `json:"segments"`
+		Blocks   map[string]string `json:"blocks"`
+	}
+
+	if json.Unmarshal(payload, &state) != nil {
+		state.Segments = nil
+		if json.Unmarshal(payload, &state.Segments) != nil {
+			return nil, errors.New("unreadable state")
+		}
+	}
+	switch {
+	case state.Version > 2:
+		return nil, errors.New("unsupported state version " + strconv.Itoa(state.Version))
+
+	case state.Version < 2 && !legacy:
+		return nil, errors.New("source modified since interrupted transfer")
+
+	case state.Source != "" && state.Source != t.config.Source:
+		return nil, errors.New("source mismatch (" + state.Source + " instead of " + t.config.Source + ")")
+
+	case state.Version >= 2 && state.Size != t.size:
+		return nil, errors.New("size mismatch (" + strconv.FormatInt(state.Size, 10) + " instead of " + strconv.FormatInt(t.size, 10) + ")")
+
+	case state.Etag != "" && state.Etag != t.etag:
+		return nil, errors.New("etag mismatch (" + state.Etag + " instead of " + t.etag + ")")
+
+	case state.Modified != 0 && state.Modified != t.modified:
+		return nil, errors.New("modification time mismatch (" + time.Unix(state.Modified, 0).UTC().Format(time.RFC3339) + " instead of " + time.Unix(t.modified, 0).UTC().Format(time.RFC3339) + ")")
+
+	case state.Target != t.resumeTarget:
+		return nil, errors.New("target mismatch (" + state.Target + " instead of " + t.resumeTarget + ")")
+
+	case len(state.Segments) == 0:
+		return nil, errors.New("empty segments layout")
+	}
+	for index, segment := range state.Segments {
+		if segment[0] < 0 || segment[0] > segment[1] || segment[1] > segment[2]+1 || segment[2] >= t.size ||
+			(index == 0 && segment[0] != 0) || (index == len(state.Segments)-1 && segment[2] != t.size-1) ||
+			(index != 0 && segment[0] != state.Segments[index-1][2]+1) {
+			return nil, errors.New("invalid segments layout")
+		}
+	}
+	for _, segment := range state.Segments {
+		atomic.AddInt64(&t.received, segment[1]-segment[0])
+	}
+	t.blocks = state.Blocks
+	return state.Segments, nil
+}
+
+func (t *Transfer) monitor(waiter *sync.WaitGroup, done chan bool) {
+	if t.config.Progress == nil {
+		return
+	}
+	waiter.Add(1)
+	go func() {
+		defer waiter.Done()
+		t.notify(Status{Event: "start"})
+		for {
+			select {
+			case <-done:
+				err := t.failure()
+				if err == nil && t.context.Err() != nil {
+					err = t.context.Err()
+				}
+				t.notify(Status{Event: "end", Err: err})
+				return
+
+			case <-time.After(time.Second):
+				t.notify(Status{Event: "progress"})
+			}
+		}
+	}()
+}
+
+func (t *Transfer) persist(waiter *sync.WaitGroup, done chan bool) {
+	if t.resume == "" {
+		return
+	}
+	waiter.Add(1)
+	go func() {
+		defer waiter.Done()
+		last, saved := time.Now(), atomic.LoadInt64(&t.received)
+		for {
+			select {
+			case <-done:
+				if t.context.Err() != nil || atomic.LoadInt64(&t.received) < t.size {
+					t.save()
+
+				} else {
+					os.Remove(t.resume)
+				}
+				return
+
+			case <-time.After(250 * time.Millisecond):
+			}
+			if received := atomic.LoadInt64(&t.received); received-saved >= 64<<20 || (received != saved && time.Since(last) >= time.Second) {
+				t.save()
+				last, saved = time.Now(), received
+			}
+		}
+	}()
+}
+
+// Run performs the transfer until completion, first fatal error or ctx cancellation; any
+// failure is reported as an *Error.
+func (t *Transfer) Run(ctx context.Context) error {
+	t.parent = ctx
+	t.context, t.cancel = context.WithCancel(ctx)
+	defer t.cancel()
+	if err := t.run(); err != nil {
+		t.lock.Lock()
+		code := t.code
+		t.lock.Unlock()
+		return &Error{Code: code, Err: err}
+	}
+	return nil
+}
+
+func (t *Transfer) run() error {
+	if !strings.HasPrefix(t.config.Source, "http") && strings.HasPrefix(t.config.Target, "http") {
+		return t.upload()
+	}
+
+	chunk := transferChunk{}
+	err := t.fetch(&chunk)
+	t.dump(chunk.request, chunk.response)
+	if err != nil {
+		return t.fail(CodeSource, err)
+	}
+	t.lock.Lock()
+	t.size, t.etag, t.modified = chunk.size, chunk.etag, chunk.modified
+	t.lock.Unlock()
+	if chunk.status == http.StatusPartialContent && t.size > 0 {
+		for _, mirror := range t.config.Mirrors {
+			if err := t.probe(mirror); err != nil {
+				t.notify(Status{Event: "ignore", Mirror: mirror, Err: err})
+			}
+		}
+	}
+	atomic.StoreInt64(&t.received, 0)
+	t.lock.Lock()
+	if chunk.status != http.StatusPartialContent || t.size < 0 {
+		t.concurrency, t.split = 1, false
+	}
+	if t.size > 0 && t.size/int64(t.concurrency) <= 4<<20 {
+		t.concurrency = int(t.size / (4 << 20))
+		if t.size%(4<<20) != 0 {
+			t.concurrency++
+		}
+	}
+	t.lock.Unlock()
+
+	var (
+		file   *os.File
+		output io.Writer
+		reader *io.PipeReader
+		writer *io.PipeWriter
+	)
+
+	waiter1, done, ranges := sync.WaitGroup{}, make(chan bool), [][3]int64{{0, 0, t.size - 1}}
+	if target := t.config.Target; target == "" {
+		output = t.config.Writer
+
+	} else if strings.HasPrefix(target, "http") {
+		method := http.MethodPut
+		if t.config.Post {
+			method = http.MethodPost
+		}
+		reader, writer = io.Pipe()
+		request, err := http.NewRequestWithContext(t.context, method, target, reader)
+		if err != nil {
+			return t.fail(CodeTarget, err)
+		}
+		request.Header.Set("User-Agent", t.config.UserAgent)
+		request.Header.Set("Content-Type", "application/octet-stream")
+		SetHeaders(request, t.config.TargetHeaders)
+		request.ContentLength = t.size
+		if t.config.Dump != nil {
+			dump, _ := httputil.DumpRequest(request, false)
+			t.dump(dump)
+		}
+		output = writer
+		waiter1.Add(1)
+		go func() {
+			defer waiter1.Done()
+			response, err := t.client.Do(request)
+			if err != nil {
+				reader.CloseWithError(t.fail(CodeUpload, err))
+				return
+			}
+			if t.config.Dump != nil {
+				dump, _ := httputil.DumpResponse(response, true)
+				t.dump([]byte("\r                                                            \n"), dump)
+			}
+			response.Body.Close()
+			if response.StatusCode/100 != 2 {
+				reader.CloseWithError(t.fail(CodeUpload, errors.New("target http status "+strconv.Itoa(response.StatusCode))))
+			}
+		}()
+
+	} else {
+		if _, err := os.Stat(target); err != nil || !t.config.Resume {
+			os.Remove(ResumePath(target))
+		}
+		os.MkdirAll(filepath.Dir(target), 0o755)
+		if t.size < 0 {
+			file, err = os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0o644)
+
+		} else {
+			file, err = os.OpenFile(target, os.O_CREATE|os.O_RDWR, 0o644)
+		}
+		if err != nil {
+			return t.fail(CodeTarget, err)
+		}
+		if t.config.Resume && t.split {
+			t.resume = ResumePath(target)
+			if payload, err := os.ReadFile(t.resume); err == nil {
+				info, err := file.Stat()
+				value, err := t.restore(payload, err == nil && chunk.modified <= info.ModTime().Unix())
+				if err == nil {
+					ranges = value
+				}
+				t.notify(Status{Event: "resume", Err: err})
+			}
+		}
+		file.Truncate(max(0, t.size))
+	}
+
+	if t.config.Verify != "" && (file != nil || output != nil) {
+		t.digest = NewDigest(t.config.Verify)
+		t.digest.restore(t.blocks)
+	}
+
+	t.lock.Lock()
+	t.start = time.Now()
+	t.lock.Unlock()
+	t.monitor(&waiter1, done)
+	t.persist(&waiter1, done)
+
+	if output == nil {
+		waiter2 := sync.WaitGroup{}
+		if t.size < 0 {
+			waiter2.Add(1)
+			go func() {
+				chunk := transferChunk{start: -1, offset: -1, end: -1, file: file}
+				if err := t.fetch(&chunk); err != nil {
+					t.fail(CodeChunk, err)
+				}
+				waiter2.Done()
+			}()
+
+		} else {
+			t.segmentsLoad(ranges)
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			if t.digest != nil && t.digest.linear != nil && file != nil {
+				go func() {
+					defer close(stopped)
+					for {
+						t.digest.follow(file, t.frontier())
+						select {
+						case <-stop:
+							return
+
+						case <-time.After(250 * time.Millisecond):
+						}
+					}
+				}()
+
+			} else {
+				close(stopped)
+			}
+			t.pool(file, nil)
+			close(stop)
+			<-stopped
+		}
+		waiter2.Wait()
+		if file != nil && t.context.Err() != nil {
+			file.Sync()
+			t.save()
+		}
+
+	} else {
+		memory := int64(t.config.Memory)
+		chunks, batches, size, index := [][3]int64{}, t.size/memory, memory/int64(t.concurrency), 0
+		if t.size%memory != 0 {
+			batches++
+		}
+		for batch := int64(0); batch < batches; batch++ {
+			for worker := 0; worker < t.concurrency; worker++ {
+				start, offset, end := (batch*memory)+int64(worker)*size, (batch*memory)+int64(worker)*size, min((batch*memory)+(int64(worker)*size)+size, t.size)-1
+				if t.size < 0 {
+					start, end = -1, -1
+				}
+				chunks = append(chunks, [3]int64{start, offset, end})
+				if end >= t.size-1 {
+					break
+				}
+			}
+		}
+
+		queue, received, sent := make(chan transferChunk, t.concurrency), make([]*transferChunk, len(chunks)), 0
+		for index = 0; index < min(t.concurrency, len(chunks)); index++ {
+			go func(index int, start, offset, end int64) {
+				chunk := transferChunk{id: index, start: start, offset: offset, end: end}
+				if start < 0 && end < 0 {
+					chunk.writer = output
+
+				} else {
+					chunk.data = bslab.Get(int(end-start+1), nil)
+					chunk.data = chunk.data[:cap(chunk.data)]
+				}
+				if err := t.fetch(&chunk); err != nil {
+					t.fail(CodeChunk, err)
+				}
+				queue <- chunk
+			}(index, chunks[index][0], chunks[index][1], chunks[index][2])
+		}
+		for t.context.Err() == nil && len(chunks) != 0 {
+			chunk := transferChunk{}
+			select {
+			case chunk = <-queue:
+			case <-t.context.Done():
+			}
+			if chunk.writer != nil || t.context.Err() != nil {
+				break
+			}
+			received[chunk.id] = &chunk
+			for sent < len(chunks) && received[sent] != nil {
+				if _, err := output.Write(received[sent].data[:received[sent].end-received[sent].start+1]); err != nil {
+					t.fail(CodeUpload, err)
+					break
+				}
+				if t.digest != nil {
+					t.digest.Write(received[sent].data[:received[sent].end-received[sent].start+1], received[sent].start)
+				}
+				bslab.Put(received[sent].data)
+				sent++
+			}
+			if sent >= len(chunks) || t.context.Err() != nil {
+				break
+			}
+			if index < len(chunks) {
+				go func(index int, start, offset, end int64) {
+					chunk := transferChunk{id: index, start: start, offset: offset, end: end, data: bslab.Get(int(end-start+1), nil)}
+					chunk.data = chunk.data[:cap(chunk.data)]
+					if err := t.fetch(&chunk); err != nil {
+						t.fail(CodeChunk, err)
+					}
+					queue <- chunk
+				}(index, chunks[index][0], chunks[index][1], chunks[index][2])
+				index++
+			}
+		}
+	}
+
+	if writer != nil {
+		if t.context.Err() != nil {
+			writer.CloseWithError(t.context.Err())
+
+		} else {
+			writer.Close()
+		}
+	}
+	if t.context.Err() != nil {
+		t.fail(CodeChunk, t.context.Err())
+	}
+	close(done)
+	waiter1.Wait()
+	if file != nil {
+		defer file.Close()
+	}
+	if errors.Is(t.failure(), ErrChanged) && t.resume != "" {
+		os.Remove(t.resume)
+	}
+	if t.context.Err() != nil {
+		return t.fail(CodeChunk, t.context.Err())
+	}
+	if err := t.verify(file); err != nil {
+		return t.fail(CodeDigest, err)
+	}
+	return nil
+}
+
+// WriteFile atomically replaces path with payload (temporary file, fsync and rename).
+func WriteFile(path string, payload []byte, mode os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(payload); err == nil {
+		if err = file.Chmod(mode); err == nil {
+			err = file.Sync()
+		}
+	}
+	if value := file.Close(); err == nil {
+		err = value
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
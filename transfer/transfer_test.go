@@ -0,0 +1,331 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPayload(t *testing.T, size int) []byte {
+	t.Helper()
+	payload := make([]byte, size)
+	rand.Read(payload)
+	return payload
+}
+
+func testSource(t *testing.T, payload []byte, handler func(http.ResponseWriter, *http.Request) bool) *httptest.Server {
+	t.Helper()
+	modified := time.Now().Add(-time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if handler != nil && !handler(response, request) {
+			return
+		}
+		if response.Header().Get("Etag") == "" {
+			response.Header().Set("Etag", `"v1"`)
+		}
+		http.ServeContent(response, request, "", modified, bytes.NewReader(payload))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testCode(t *testing.T, err error, code int) {
+	t.Helper()
+	var failure *Error
+	if !errors.As(err, &failure) {
+		t.Fatalf("expected *Error with code %d, got %v", code, err)
+	}
+	if failure.Code != code {
+		t.Fatalf("expected code %d, got %d (%v)", code, failure.Code, failure.Err)
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	transfer := New(Config{Source: "http://localhost/"})
+	if transfer.config.Retries != 5 || transfer.config.Concurrency != 6 || transfer.config.UserAgent != "mfetch/"+Version {
+		t.Fatalf("unexpected defaults %+v", transfer.config)
+	}
+	if transfer = New(Config{Retries: -1, Adaptive: true}); transfer.config.Retries != 0 || transfer.config.Concurrency != 32 {
+		t.Fatalf("unexpected defaults %+v", transfer.config)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	payload := testPayload(t, 20<<20)
+	agent := ""
+	server := testSource(t, payload, func(response http.ResponseWriter, request *http.Request) bool {
+		agent = request.Header.Get("User-Agent")
+		return true
+	})
+
+	target, events := filepath.Join(t.TempDir(), "target"), map[string]int{}
+	lock := sync.Mutex{}
+	transfer := New(Config{Source: server.URL, Target: target, Resume: true, Progress: func(status Status) {
+		lock.Lock()
+		events[status.Event]++
+		lock.Unlock()
+	}})
+	if err := transfer.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(target); !bytes.Equal(content, payload) {
+		t.Fatal("content mismatch")
+	}
+	if _, err := os.Stat(ResumePath(target)); err == nil {
+		t.Fatal("resume state left behind")
+	}
+	if status := transfer.Status(); status.Size != int64(len(payload)) || status.Received != int64(len(payload)) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if events["start"] != 1 || events["end"] != 1 {
+		t.Fatalf("unexpected events %v", events)
+	}
+	if agent != "mfetch/"+Version {
+		t.Fatalf("unexpected user-agent %q", agent)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	payload := testPayload(t, 50<<20)
+	server := testSource(t, payload, nil)
+
+	output := &bytes.Buffer{}
+	if err := New(Config{Source: server.URL, Writer: output, Concurrency: 4, Memory: 32 << 20}).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), payload) {
+		t.Fatal("content mismatch")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	output.Reset()
+	if err := New(Config{Source: testSource(t, nil, nil).URL, Writer: output}).Run(ctx); err != nil || output.Len() != 0 {
+		t.Fatalf("unexpected empty document transfer result %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	payload := testPayload(t, 8<<20)
+	failures := int64(2)
+	server := testSource(t, payload, func(response http.ResponseWriter, request *http.Request) bool {
+		if request.Header.Get("Range") != "bytes=0-0" && atomic.AddInt64(&failures, -1) >= 0 {
+			response.WriteHeader(http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	})
+
+	target := filepath.Join(t.TempDir(), "target")
+	transfer := New(Config{Source: server.URL, Target: target, Concurrency: 1})
+	if err := transfer.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if retries := transfer.Status().Retries; retries != 2 {
+		t.Fatalf("expected 2 retries, got %d", retries)
+	}
+
+	atomic.StoreInt64(&failures, 1)
+	testCode(t, New(Config{Source: server.URL, Target: target, Retries: -1}).Run(context.Background()), CodeChunk)
+}
+
+func TestVerify(t *testing.T) {
+	payload := testPayload(t, 10<<20)
+	sum, digest := sha256.Sum256(payload), ""
+	server := testSource(t, payload, func(response http.ResponseWriter, request *http.Request) bool {
+		response.Header().Set("Repr-Digest", digest)
+		return true
+	})
+
+	for _, ordered := range []bool{false, true} {
+		config := Config{Source: server.URL, Verify: DigestLinear}
+		if ordered {
+			config.Writer = io.Discard
+
+		} else {
+			config.Target = filepath.Join(t.TempDir(), "target")
+		}
+
+		digest = "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+		verified := []byte(nil)
+		config.Progress = func(status Status) {
+			if status.Event == "verify" {
+				verified = status.Digest
+			}
+		}
+		if err := New(config).Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(verified, sum[:]) {
+			t.Fatal("missing verify event")
+		}
+
+		digest = "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)) + ":"
+		config.Progress = nil
+		testCode(t, New(config).Run(context.Background()), CodeDigest)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	payload := testPayload(t, 20<<20)
+	requests := int64(0)
+	server := testSource(t, payload, func(response http.ResponseWriter, request *http.Request) bool {
+		if atomic.AddInt64(&requests, 1) > 1 {
+			response.Header().Set("Etag", `"v2"`)
+		}
+		return true
+	})
+
+	err := New(Config{Source: server.URL, Target: filepath.Join(t.TempDir(), "target")}).Run(context.Background())
+	testCode(t, err, CodeChanged)
+	if !errors.Is(err, ErrChanged) {
+		t.Fatalf("expected ErrChanged, got %v", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	payload := testPayload(t, 12<<20)
+	sum := sha256.Sum256(payload)
+	received, digest, lock := make([]byte, len(payload)), "", sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		captures := regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`).FindStringSubmatch(request.Header.Get("Content-Range"))
+		if captures == nil {
+			lock.Lock()
+			digest = request.Header.Get("Repr-Digest")
+			lock.Unlock()
+			return
+		}
+		start, _ := strconv.ParseInt(captures[1], 10, 64)
+		data, err := io.ReadAll(request.Body)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		copy(received[start:], data)
+		lock.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	source := filepath.Join(t.TempDir(), "source")
+	os.WriteFile(source, payload, 0o644)
+	if err := New(Config{Source: source, Target: server.URL + "/target", Verify: DigestLinear, Resume: true}).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatal("content mismatch")
+	}
+	if digest != "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":" {
+		t.Fatalf("unexpected digest %q", digest)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(source), ".source.upload")); err == nil {
+		t.Fatal("upload state left behind")
+	}
+}
+
+func TestResume(t *testing.T) {
+	payload := testPayload(t, 64<<20)
+	digest := NewDigest(DigestTree)
+	digest.Write(payload, 0)
+	sum, _ := digest.Sum(nil, int64(len(payload)))
+	server := testSource(t, payload, func(response http.ResponseWriter, request *http.Request) bool {
+		response.Header().Set("Repr-Digest", DigestTree+"=:"+base64.StdEncoding.EncodeToString(sum)+":")
+		return true
+	})
+	target := filepath.Join(t.TempDir(), "target")
+
+	// the first run is slowed down and killed once its progress has been persisted (without any progress callback)
+	limiter := &Limiter{}
+	limiter.Set(float64(len(payload) * 8 / 4))
+	ctx, cancel := context.WithCancel(context.Background())
+	config := Config{Source: server.URL, Target: target, Resume: true, Verify: DigestTree, Limiter: limiter}
+	first, persisted := New(config), int64(0)
+	go func() {
+		defer cancel()
+		for first.Status().Received < int64(len(payload))*3/4 {
+			var state struct {
+				Segments [][3]int64 `json:"segments"`
+			}
+			if payload, err := os.ReadFile(ResumePath(target)); err == nil && json.Unmarshal(payload, &state) == nil {
+				for _, segment := range state.Segments {
+					persisted += segment[1] - segment[0]
+				}
+				if persisted > 0 {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	err := first.Run(ctx)
+	testCode(t, err, CodeInterrupted)
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected ErrInterrupted, got %v", err)
+	}
+	if persisted <= 0 {
+		t.Fatal("resume state not persisted during the transfer")
+	}
+
+	// the second run picks up where the first one stopped
+	resumed := int64(-1)
+	config.Limiter, config.Progress = nil, func(status Status) {
+		if status.Event == "resume" {
+			if status.Err != nil {
+				t.Errorf("resume state refused (%v)", status.Err)
+			}
+			resumed = status.Received
+		}
+	}
+	second := New(config)
+	if err := second.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resumed < persisted || resumed >= int64(len(payload)) {
+		t.Fatalf("unexpected resumed count %d (%d persisted)", resumed, persisted)
+	}
+	if content, _ := os.ReadFile(target); !bytes.Equal(content, payload) {
+		t.Fatal("content mismatch")
+	}
+	if _, err := os.Stat(ResumePath(target)); err == nil {
+		t.Fatal("resume state left behind")
+	}
+}
+
+func TestResumeSource(t *testing.T) {
+	payload := testPayload(t, 8<<20)
+	server := testSource(t, payload, nil)
+	target := filepath.Join(t.TempDir(), "target")
+	os.WriteFile(target, make([]byte, len(payload)), 0o644)
+	state, _ := json.Marshal(map[string]any{"version": 2, "source": server.URL + "/other", "size": len(payload), "etag": `"v1"`, "segments": [][3]int64{{0, 4 << 20, int64(len(payload)) - 1}}})
+	os.WriteFile(ResumePath(target), state, 0o644)
+
+	refused := error(nil)
+	if err := New(Config{Source: server.URL, Target: target, Resume: true, Progress: func(status Status) {
+		if status.Event == "resume" {
+			refused = status.Err
+		}
+	}}).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if refused == nil {
+		t.Fatal("resume state for another source accepted")
+	}
+	if content, _ := os.ReadFile(target); !bytes.Equal(content, payload) {
+		t.Fatal("content mismatch")
+	}
+}
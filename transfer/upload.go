@@ -0,0 +1,199 @@
+package transfer
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type uploadReader struct {
+	transfer *Transfer
+	reader   *io.SectionReader
+	offset   int64
+	sent     int64
+}
+
+func (ur *uploadReader) Read(data []byte) (n int, err error) {
+	n, err = ur.reader.Read(data)
+	if n > 0 {
+		if err := ur.transfer.config.Limiter.Wait(ur.transfer.context, n); err != nil {
+			return 0, err
+		}
+		if ur.transfer.digest != nil {
+			ur.transfer.digest.Write(data[:n], ur.offset)
+		}
+		atomic.AddInt64(&ur.transfer.received, int64(n))
+		ur.offset += int64(n)
+		ur.sent += int64(n)
+	}
+	return
+}
+
+func (t *Transfer) uploadNew(body io.Reader) (request *http.Request, err error) {
+	method := http.MethodPut
+	if t.config.Post {
+		method = http.MethodPost
+	}
+	request, err = http.NewRequestWithContext(t.context, method, t.config.Target, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", t.config.UserAgent)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	SetHeaders(request, t.config.TargetHeaders)
+	return request, nil
+}
+
+func (t *Transfer) uploadRequest(chunk *transferChunk) (err error) {
+	reader := &uploadReader{transfer: t, reader: io.NewSectionReader(chunk.source, chunk.offset, chunk.end-chunk.offset+1), offset: chunk.offset}
+	request, err := t.uploadNew(reader)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = chunk.end - chunk.offset + 1
+	request.Header.Set("Content-Range", "bytes "+strconv.FormatInt(chunk.offset, 10)+"-"+strconv.FormatInt(chunk.end, 10)+"/"+strconv.FormatInt(t.size, 10))
+	if t.config.Dump != nil {
+		chunk.request, _ = httputil.DumpRequest(request, false)
+	}
+
+	response, err := t.client.Do(request)
+	if err == nil {
+		if t.config.Dump != nil {
+			chunk.response, _ = httputil.DumpResponse(response, false)
+		}
+		io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+		response.Body.Close()
+		if chunk.status = response.StatusCode; chunk.status/100 != 2 {
+			err = errors.New("target http status " + strconv.Itoa(chunk.status))
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&t.received, -reader.sent)
+		return err
+	}
+
+	chunk.offset = chunk.end + 1
+	if chunk.segment != nil {
+		t.slock.Lock()
+		chunk.segment.offset = chunk.offset
+		t.slock.Unlock()
+	}
+	return nil
+}
+
+func (t *Transfer) uploadFinalize(file *os.File) (err error) {
+	request, err := t.uploadNew(http.NoBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(t.size, 10))
+	if t.digest != nil {
+		sum, err := t.digest.Sum(file, t.size)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Repr-Digest", t.digest.algorithm+"=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	}
+	if t.config.Dump != nil {
+		dump, _ := httputil.DumpRequest(request, false)
+		t.dump([]byte("\r"), dump)
+	}
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	if t.config.Dump != nil {
+		dump, _ := httputil.DumpResponse(response, true)
+		t.dump([]byte("\r"), dump)
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return errors.New("target http status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
+func (t *Transfer) upload() error {
+	source := t.config.Source
+	file, err := os.Open(source)
+	if err != nil {
+		return t.fail(CodeSource, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return t.fail(CodeSource, err)
+	}
+	if !info.Mode().IsRegular() {
+		return t.fail(CodeSource, errors.New(source+" is not a regular file"))
+	}
+	t.lock.Lock()
+	t.size, t.modified, t.steal = info.Size(), info.ModTime().Unix(), false
+	if t.size/int64(t.concurrency) <= 4<<20 {
+		t.concurrency = int(t.size / (4 << 20))
+		if t.size%(4<<20) != 0 {
+			t.concurrency++
+		}
+	}
+	t.lock.Unlock()
+
+	ranges, resume := [][3]int64{{0, 0, t.size - 1}}, filepath.Join(filepath.Dir(source), "."+filepath.Base(source)+".upload")
+	if !t.config.Resume {
+		os.Remove(resume)
+
+	} else {
+		t.resume, t.resumeTarget = resume, t.config.Target
+		if payload, err := os.ReadFile(t.resume); err == nil {
+			resume, err := os.Stat(t.resume)
+			value, err := t.restore(payload, err == nil && !resume.ModTime().Before(info.ModTime()))
+			if err == nil {
+				ranges = value
+			}
+			t.notify(Status{Event: "resume", Err: err})
+		}
+	}
+
+	if t.config.Verify != "" {
+		t.digest = NewDigest(t.config.Verify)
+		t.digest.restore(t.blocks)
+		if t.digest.linear != nil {
+			go t.digest.follow(file, t.size)
+		}
+	}
+
+	t.lock.Lock()
+	t.start = time.Now()
+	t.lock.Unlock()
+	waiter, done := sync.WaitGroup{}, make(chan bool)
+	t.monitor(&waiter, done)
+	t.persist(&waiter, done)
+	t.segmentsLoad(ranges)
+	t.pool(nil, file)
+	t.save()
+	if t.context.Err() == nil {
+		if err := t.uploadFinalize(file); err != nil {
+			t.fail(CodeUpload, err)
+
+		} else if t.resume != "" {
+			os.Remove(t.resume)
+		}
+	}
+	if t.context.Err() != nil {
+		t.fail(CodeChunk, t.context.Err())
+	}
+	close(done)
+	waiter.Wait()
+	if t.context.Err() != nil {
+		return t.fail(CodeChunk, t.context.Err())
+	}
+	return nil
+}
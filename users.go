@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pyke369/golang-support/auth"
+)
+
+type usersAccount struct {
+	login    string
+	hash     string
+	root     string
+	writable bool
+	handler  http.Handler
+}
+
+var (
+	usersAccounts = map[string]*usersAccount{}
+	usersLock     sync.RWMutex
+)
+
+func usersLoad() error {
+	content, err := os.ReadFile(Users)
+	if err != nil {
+		return err
+	}
+	accounts := map[string]*usersAccount{}
+	for index, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 3 || len(parts) > 4 || parts[0] == "" {
+			return errors.New("invalid users file line " + strconv.Itoa(index+1))
+		}
+		if parts[1] == "" {
+			return errors.New("empty users file password line " + strconv.Itoa(index+1))
+		}
+		if strings.HasPrefix(parts[1], "$") && !strings.HasPrefix(parts[1], "$6$") {
+			return errors.New("unsupported users file password hash scheme line " + strconv.Itoa(index+1))
+		}
+		account := &usersAccount{login: parts[0], hash: parts[1], root: parts[2], writable: Writable}
+		if len(parts) > 3 {
+			switch parts[3] {
+			case "rw":
+				account.writable = true
+
+			case "ro":
+				account.writable = false
+
+			default:
+				return errors.New("invalid users file permission " + parts[3] + " line " + strconv.Itoa(index+1))
+			}
+		}
+		if Flagset.NArg() > 0 {
+			if account.root == "" {
+				account.root = Flagset.Args()[0]
+
+			} else if !filepath.IsAbs(account.root) {
+				account.root = filepath.Join(Flagset.Args()[0], account.root)
+			}
+		}
+		if account.root != "" {
+			if info, err := os.Stat(account.root); err != nil || !info.IsDir() {
+				return errors.New("invalid users file folder " + account.root + " line " + strconv.Itoa(index+1))
+			}
+		}
+		account.writable = account.writable && account.root != ""
+		account.handler = serverHandler(account.root, account.writable)
+		accounts[account.login] = account
+	}
+
+	usersLock.Lock()
+	usersAccounts = accounts
+	usersLock.Unlock()
+	return nil
+}
+
+func usersLookup(login string) (account *usersAccount) {
+	usersLock.RLock()
+	account = usersAccounts[login]
+	usersLock.RUnlock()
+	return
+}
+
+func usersAuthenticate(login, password string) *usersAccount {
+	if account := usersLookup(login); account != nil {
+		if match, _ := auth.Password(password, []string{account.hash}, false); match {
+			return account
+		}
+	}
+	return nil
+}
+
+func usersRun() {
+	if err := usersLoad(); err != nil {
+		os.Stderr.WriteString(err.Error() + " - aborting\n")
+		os.Exit(1)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := usersLoad(); err != nil {
+				os.Stderr.WriteString("\r" + err.Error() + " - ignoring     \n")
+			}
+		}
+	}()
+}
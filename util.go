@@ -1,8 +1,15 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"strconv"
+	"strings"
 
+	"github.com/pyke369/golang-support/rcache"
 	"github.com/pyke369/golang-support/ustr"
 )
 
@@ -49,3 +56,64 @@ func utilBandwidth(bandwidth float64) string {
 		return strconv.FormatFloat(bandwidth/(1000*1000*1000), 'f', 1, 64) + "Gb/s"
 	}
 }
+
+func utilParseBandwidth(value string) (bandwidth float64, err error) {
+	if value = strings.TrimSpace(value); value == "" {
+		return 0, nil
+	}
+	captures := rcache.Get(`^(\d+(?:\.\d+)?)\s*([kKmMgGtT]?)([bB]?)(?:/s|ps)?$`).FindStringSubmatch(value)
+	if captures == nil {
+		return 0, errors.New("invalid bandwidth " + value)
+	}
+	bandwidth, _ = strconv.ParseFloat(captures[1], 64)
+	switch strings.ToLower(captures[2]) {
+	case "k":
+		bandwidth *= 1000
+
+	case "m":
+		bandwidth *= 1000 * 1000
+
+	case "g":
+		bandwidth *= 1000 * 1000 * 1000
+
+	case "t":
+		bandwidth *= 1000 * 1000 * 1000 * 1000
+	}
+	if captures[3] == "B" {
+		bandwidth *= 8
+	}
+	return bandwidth, nil
+}
+
+func utilSignature(secret, path, scope string, expires int64, address string) string {
+	// single-file and scoped signatures never share the same MAC input
+	kind, value := "path", path
+	if scope != "" {
+		kind, value = "scope", scope
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(kind + "\n" + strconv.Quote(value) + "\n" + strconv.FormatInt(expires, 10) + "\n" + address))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func utilFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func utilPin(value string) (pin string, err error) {
+	value = strings.TrimSpace(value)
+	for _, prefix := range []string{"sha256:", "sha256//", "sha256/", "sha-256:"} {
+		if len(value) > len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+			value = value[len(prefix):]
+			break
+		}
+	}
+	if sum, err := hex.DecodeString(strings.ReplaceAll(value, ":", "")); err == nil && len(sum) == sha256.Size {
+		return "sha256:" + hex.EncodeToString(sum), nil
+	}
+	if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == sha256.Size {
+		return "sha256:" + hex.EncodeToString(sum), nil
+	}
+	return "", errors.New("invalid certificate fingerprint " + value)
+}